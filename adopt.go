@@ -0,0 +1,311 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Where the bootstrap script is uploaded to on adopted instances.
+const ADOPT_BOOTSTRAP_FILE = "/tmp/salter-bootstrap.sh"
+
+// Brings instances that were launched by hand under salter's management.
+// Each argument maps a configured node to an existing instance, either by id
+// (node=i-1a2b3c4d) or by a tag filter that matches exactly one instance in
+// the node's region (node=tag:Key=Value).
+func adopt() error {
+	if len(G_ARGS) == 0 {
+		errorf("usage: salter adopt <node>=<instance-id>|<node>=tag:<key>=<value> ...\n")
+		return fmt.Errorf("no instances to adopt")
+	}
+
+	targets := make(map[string]*Node)
+	selectors := make(map[string]string)
+	for _, arg := range G_ARGS {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			errorf("Invalid adoption %s; expected <node>=<instance>.\n", arg)
+			return fmt.Errorf("invalid adoption %s", arg)
+		}
+
+		node, found := G_CONFIG.Nodes[parts[0]]
+		if !found {
+			errorf("Node %s is not in the config.\n", parts[0])
+			return fmt.Errorf("unknown node %s", parts[0])
+		} else if _, found := targets[node.Name]; found {
+			errorf("Node %s can only adopt one instance.\n", node.Name)
+			return fmt.Errorf("%s adopted twice", node.Name)
+		}
+
+		for _, role := range node.Roles {
+			if role == "saltmaster" {
+				errorf("The salt master can not be adopted.\n")
+				return fmt.Errorf("%s is the master", node.Name)
+			}
+		}
+
+		targets[node.Name] = node
+		selectors[node.Name] = parts[1]
+	}
+
+	// The master accepts the keys of the adopted minions.
+	master := G_CONFIG.findNodeByRole("saltmaster")
+	if master == nil {
+		errorf("No node has the saltmaster role.\n")
+		return fmt.Errorf("missing master node")
+	} else if err := master.Update(); err != nil {
+		errorf("Unable to retrieve status of %s from AWS: %+v\n",
+			master.Name, err)
+		return err
+	} else if !master.IsRunning() {
+		errorf("Master %s is not running.\n", master.Name)
+		return fmt.Errorf("%s is not running", master.Name)
+	} else if err := master.SshOpen(); err != nil {
+		errorf("Unable to open SSH connection to master: %+v\n", err)
+		return err
+	}
+
+	failed := 0
+	var failedLock sync.Mutex
+	pForEachValue(targets, func(node *Node) error {
+		err := adoptNode(node, selectors[node.Name], master)
+		if err != nil {
+			errorf("%s: not adopted; %+v\n", node.Name, err)
+			failedLock.Lock()
+			failed++
+			failedLock.Unlock()
+		}
+		return err
+	}, ARG_PARALLEL)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes not adopted", failed, len(targets))
+	}
+	return nil
+}
+
+func adoptNode(node *Node, selector string, master *Node) error {
+	// An instance named after the node without a cluster tag is what
+	// adoption is for, so only an instance already in the cluster counts.
+	err := node.updateClaimed()
+	if err != nil {
+		return err
+	} else if node.Instance != nil {
+		return fmt.Errorf("node already has instance %s",
+			node.Instance.InstanceId)
+	}
+
+	instance, err := findAdoptee(node, selector)
+	if err != nil {
+		return err
+	}
+
+	// An instance that already belongs to another cluster or node stays
+	// there. One already named after the node, as hand launched instances
+	// often are, is the node's to take.
+	if cluster, found := findTag(instance.Tags, CLUSTER_TAG); found &&
+		cluster != G_CONFIG.Cluster {
+		return fmt.Errorf("%s belongs to cluster %s", instance.InstanceId,
+			cluster)
+	} else if name, _ := findTag(instance.Tags, "Name"); name != node.Name &&
+		G_CONFIG.Nodes[name] != nil {
+		return fmt.Errorf("%s is already node %s", instance.InstanceId, name)
+	}
+
+	if instance.State.Name != "running" {
+		return fmt.Errorf("%s is %s", instance.InstanceId,
+			instance.State.Name)
+	}
+
+	err = node.checkAdoptee(instance)
+	if err != nil {
+		return err
+	}
+
+	// From here on the instance is the node's.
+	node.Instance = instance
+	err = node.ApplyTags()
+	if err != nil {
+		return err
+	}
+
+	err = node.tagAmi(instance.ImageId)
+	if err != nil {
+		return err
+	}
+	printf("%s (%s): adopted\n", node.Name, instance.InstanceId)
+
+	err = node.AttachVolumes()
+	if err != nil {
+		return err
+	}
+
+	err = node.AssociateAddress()
+	if err != nil {
+		return err
+	}
+
+	// Run the same bootstrap script that a launched node gets as its user
+	// data; this sets up the hostname, grains and minion config and installs
+	// salt, leaving the minion stopped until its key is distributed.
+	masterIp, err := masterAddress(node, master)
+	if err != nil {
+		return err
+	}
+
+	userData, err := G_CONFIG.generateUserData(node.Name, node.Roles, masterIp)
+	if err != nil {
+		return err
+	}
+
+	printf("%s: installing salt-minion\n", node.Name)
+	err = node.SshUpload(ADOPT_BOOTSTRAP_FILE, userData)
+	if err != nil {
+		return fmt.Errorf("unable to upload bootstrap script: %+v", err)
+	}
+
+	err = node.SshRun("/usr/bin/sudo /bin/bash " + ADOPT_BOOTSTRAP_FILE +
+		" && /usr/bin/sudo rm -f " + ADOPT_BOOTSTRAP_FILE)
+	if err != nil {
+		return fmt.Errorf("bootstrap script failed: %+v", err)
+	}
+
+	node.SshRun("/usr/bin/sudo mkdir -p /etc/salt/pki/minion")
+	distributeKeys(node, master)
+	displayNodeInfo(node)
+	node.SshClose()
+	return nil
+}
+
+// Splits a selector into either an instance id or the key and value of a
+// tag.
+func parseAdoptSelector(selector string) (string, string, string, error) {
+	if !strings.HasPrefix(selector, "tag:") {
+		if !strings.HasPrefix(selector, "i-") {
+			return "", "", "", fmt.Errorf("invalid instance id %s", selector)
+		}
+		return selector, "", "", nil
+	}
+
+	kv := strings.SplitN(strings.TrimPrefix(selector, "tag:"), "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", "", fmt.Errorf("invalid tag filter %s", selector)
+	}
+	return "", kv[0], kv[1], nil
+}
+
+// Finds the single instance in the node's region that the selector names.
+func findAdoptee(node *Node, selector string) (*ec2.Instance, error) {
+	id, key, value, err := parseAdoptSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	filter := ec2.NewFilter()
+	if id == "" {
+		filter.Add("tag:"+key, value)
+		filter.Add("instance-state-code",
+			fmt.Sprint(STATE_PENDING), fmt.Sprint(STATE_RUNNING),
+			fmt.Sprint(STATE_STOPPING), fmt.Sprint(STATE_STOPPED))
+	} else {
+		ids = []string{id}
+	}
+
+	resp, err := node.Conn().Instances(ids, filter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find %s: %+v", selector, err)
+	}
+
+	var instances []ec2.Instance
+	for _, reservation := range resp.Reservations {
+		instances = append(instances, reservation.Instances...)
+	}
+
+	switch len(instances) {
+	case 0:
+		return nil, fmt.Errorf("no instance matches %s in %s", selector,
+			node.RegionId)
+	case 1:
+		return &instances[0], nil
+	default:
+		return nil, fmt.Errorf("%d instances match %s", len(instances),
+			selector)
+	}
+}
+
+// Checks that the instance looks like one salter would have launched for the
+// node, so that later commands treat it the same way.
+func (node *Node) checkAdoptee(instance *ec2.Instance) error {
+	if instance.InstanceType != node.Flavor {
+		return fmt.Errorf("%s is %s, not %s", instance.InstanceId,
+			instance.InstanceType, node.Flavor)
+	}
+
+	if instance.KeyName != node.KeyName {
+		return fmt.Errorf("%s uses key %s, not %s", instance.InstanceId,
+			instance.KeyName, node.KeyName)
+	} else if !RegionKeyExists(node.KeyName, node.RegionId) {
+		return fmt.Errorf("key %s is not available locally", node.KeyName)
+	}
+
+	err := node.ResolveAmi()
+	if err != nil {
+		return err
+	} else if instance.ImageId != node.AmiId {
+		return fmt.Errorf("%s was launched from %s, not %s",
+			instance.InstanceId, instance.ImageId, node.AmiId)
+	}
+
+	vpcId, err := node.vpcId()
+	if err != nil {
+		return err
+	} else if instance.VpcId != vpcId {
+		return fmt.Errorf("%s is in vpc %q, not %q", instance.InstanceId,
+			instance.VpcId, vpcId)
+	} else if node.Subnet != "" && instance.SubnetId != node.Subnet {
+		return fmt.Errorf("%s is in subnet %s, not %s", instance.InstanceId,
+			instance.SubnetId, node.Subnet)
+	}
+
+	// Security groups can not be changed on EC2-Classic instances, so every
+	// configured group must already be there.
+	groups := make(map[string]bool)
+	for _, sg := range instance.SecurityGroups {
+		groups[sg.Id] = true
+	}
+	for _, name := range node.SGroup {
+		if !RegionSGExists(name, node.Vpc, node.RegionId) {
+			return fmt.Errorf("security group %s is not available", name)
+		} else if sg := RegionSG(name, node.Vpc, node.RegionId); !groups[sg.Id] {
+			return fmt.Errorf("%s is not in security group %s (%s)",
+				instance.InstanceId, name, sg.Id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseAdoptSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		id       string
+		key      string
+		value    string
+		valid    bool
+	}{
+		{"i-1a2b3c4d", "i-1a2b3c4d", "", "", true},
+		{"tag:Name=web1", "", "Name", "web1", true},
+		{"tag:Role=db=primary", "", "Role", "db=primary", true},
+		{"tag:Empty=", "", "Empty", "", true},
+		{"tag:Name", "", "", "", false},
+		{"tag:=web1", "", "", "", false},
+		{"web1", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		id, key, value, err := parseAdoptSelector(test.selector)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.selector)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.selector, err)
+		} else if id != test.id || key != test.key || value != test.value {
+			t.Errorf("%s: expected (%q, %q, %q), got (%q, %q, %q)",
+				test.selector, test.id, test.key, test.value, id, key,
+				value)
+		}
+	}
+}
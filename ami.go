@@ -0,0 +1,236 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// The instance tag that records the AMI a node was launched from.
+const AMI_TAG = "AMI"
+
+// Describes the AMI to launch a node from. In the config file this is either
+// a literal AMI id:
+//
+//	ami = "ami-d1b92ae1"
+//
+// or a table describing how to look the image up in each region:
+//
+//	[aws.ami]
+//	owner = "099720109477"
+//	name = "ubuntu/images/hvm-ssd/ubuntu-trusty-14.04-amd64-server-*"
+//	architecture = "x86_64"
+//	virtualization = "hvm"
+//	latest = true
+//
+// The name may contain wildcards. If more than one image matches then
+// latest must be set, in which case the image whose name sorts last is
+// used; image names conventionally end in their build date.
+type AmiSpec struct {
+	Id             string
+	Owner          string
+	Name           string
+	Architecture   string
+	Virtualization string
+	Latest         bool
+}
+
+func (a *AmiSpec) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*a = AmiSpec{Id: value}
+		return nil
+	case map[string]interface{}:
+		*a = AmiSpec{}
+	default:
+		return fmt.Errorf("ami must be an id or a table: %v", data)
+	}
+
+	for key, item := range data.(map[string]interface{}) {
+		if key == "latest" {
+			latest, ok := item.(bool)
+			if !ok {
+				return fmt.Errorf("ami latest must be a boolean: %v", item)
+			}
+			a.Latest = latest
+			continue
+		}
+
+		str, ok := item.(string)
+		if !ok {
+			return fmt.Errorf("ami %s must be a string: %v", key, item)
+		}
+
+		switch key {
+		case "id":
+			a.Id = str
+		case "owner":
+			a.Owner = str
+		case "name":
+			a.Name = str
+		case "architecture":
+			a.Architecture = str
+		case "virtualization":
+			a.Virtualization = str
+		default:
+			return fmt.Errorf("unknown ami key: %s", key)
+		}
+	}
+
+	if a.Id != "" && (a.Owner != "" || a.Name != "" || a.Architecture != "" ||
+		a.Virtualization != "") {
+		return fmt.Errorf("ami id can not be combined with a lookup")
+	} else if a.Id == "" && a.Name == "" {
+		return fmt.Errorf("ami lookups require a name")
+	}
+	return nil
+}
+
+func (a AmiSpec) IsEmpty() bool {
+	return a == AmiSpec{}
+}
+
+// Formats the spec for display by the dump command.
+func (a AmiSpec) String() string {
+	if a.Id != "" || a.IsEmpty() {
+		return a.Id
+	}
+
+	parts := []string{}
+	if a.Owner != "" {
+		parts = append(parts, "owner="+a.Owner)
+	}
+	parts = append(parts, "name="+a.Name)
+	if a.Architecture != "" {
+		parts = append(parts, "architecture="+a.Architecture)
+	}
+	if a.Virtualization != "" {
+		parts = append(parts, "virtualization="+a.Virtualization)
+	}
+	if a.Latest {
+		parts = append(parts, "latest")
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// Lookups are cached by region and spec, since every node in a region will
+// usually share the same spec.
+var amiCache = make(map[string]string)
+var amiCacheLock sync.Mutex
+
+// Resolves the spec into an AMI id in the region the connection is for.
+func (a AmiSpec) Resolve(conn *ec2.EC2) (string, error) {
+	if a.Id != "" {
+		return a.Id, nil
+	}
+
+	cacheKey := conn.Region.Name + " " + a.String()
+	amiCacheLock.Lock()
+	defer amiCacheLock.Unlock()
+	if id, found := amiCache[cacheKey]; found {
+		return id, nil
+	}
+
+	filter := ec2.NewFilter()
+	filter.Add("state", "available")
+	filter.Add("name", a.Name)
+	if a.Architecture != "" {
+		filter.Add("architecture", a.Architecture)
+	}
+	if a.Virtualization != "" {
+		filter.Add("virtualization-type", a.Virtualization)
+	}
+
+	var resp *ec2.ImagesResp
+	var err error
+	if a.Owner != "" {
+		resp, err = conn.ImagesByOwners(nil, []string{a.Owner}, filter)
+	} else {
+		resp, err = conn.Images(nil, filter)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to look up ami %s: %+v", a, err)
+	}
+
+	switch {
+	case len(resp.Images) == 0:
+		return "", fmt.Errorf("no ami matches %s in %s", a, conn.Region.Name)
+	case len(resp.Images) > 1 && !a.Latest:
+		return "", fmt.Errorf("%d amis match %s in %s; set latest",
+			len(resp.Images), a, conn.Region.Name)
+	}
+
+	images := resp.Images
+	sort.Sort(imagesByName(images))
+	id := images[len(images)-1].Id
+	debugf("Resolved ami %s in %s to %s (%s)\n", a, conn.Region.Name, id,
+		images[len(images)-1].Name)
+
+	amiCache[cacheKey] = id
+	return id, nil
+}
+
+type imagesByName []ec2.Image
+
+func (l imagesByName) Len() int           { return len(l) }
+func (l imagesByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l imagesByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Works out the AMI the node should be launched from and stores it in
+// AmiId. Nodes that name an image role use the latest image baked for that
+// role, falling back to the ami if none has been baked yet.
+func (node *Node) ResolveAmi() error {
+	if node.AmiId != "" {
+		return nil
+	}
+
+	if node.Image != "" {
+		role := imageRole(strings.Split(node.Image, ","))
+		img, err := findRoleImage(node.Conn(), role)
+		if err != nil {
+			return fmt.Errorf("unable to find image for %s: %+v", role, err)
+		} else if img != nil {
+			debugf("%s: using image %s for %s\n", node.Name, img.Id, role)
+			node.AmiId = img.Id
+			return nil
+		} else if node.Ami.IsEmpty() {
+			return fmt.Errorf("no image baked for %s", role)
+		}
+		printf("%s: no image baked for %s; using %s\n", node.Name, role,
+			node.Ami)
+	} else if node.Ami.IsEmpty() {
+		return fmt.Errorf("no ami configured")
+	}
+
+	id, err := node.Ami.Resolve(node.Conn())
+	if err != nil {
+		return err
+	}
+	node.AmiId = id
+	return nil
+}
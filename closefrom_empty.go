@@ -20,7 +20,7 @@
 //
 // -------------------------------------------------------------------
 
-// +build (NOT darwin) AND (NOT linux)
+// +build !darwin,!linux
 
 package main
 
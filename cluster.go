@@ -0,0 +1,64 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// The tag that records which cluster a resource belongs to. Every resource
+// salter creates carries it, and every lookup is restricted to it, so that
+// clusters sharing an account can use the same node names.
+const CLUSTER_TAG = "SalterCluster"
+
+// Returns the cluster tag for this config's cluster.
+func clusterTag() ec2.Tag {
+	return ec2.Tag{Key: CLUSTER_TAG, Value: G_CONFIG.Cluster}
+}
+
+// Appends the cluster tag to a set of tags about to be applied.
+func withClusterTag(tags ...ec2.Tag) []ec2.Tag {
+	return append(tags, clusterTag())
+}
+
+// Restricts a lookup to resources of this config's cluster.
+func addClusterFilter(filter *ec2.Filter) {
+	filter.Add("tag:"+CLUSTER_TAG, G_CONFIG.Cluster)
+}
+
+// Checks that a resource found by some other means than a cluster filtered
+// lookup belongs to this config's cluster.
+func checkCluster(id string, tags []ec2.Tag) error {
+	cluster, found := findTag(tags, CLUSTER_TAG)
+	switch {
+	case !found:
+		return fmt.Errorf("%s has no %s tag; if it belongs to this cluster, "+
+			"tag it with %s=%s", id, CLUSTER_TAG, CLUSTER_TAG,
+			G_CONFIG.Cluster)
+	case cluster != G_CONFIG.Cluster:
+		return fmt.Errorf("%s belongs to cluster %s", id, cluster)
+	}
+	return nil
+}
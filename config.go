@@ -30,19 +30,29 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"text/template"
 
 	"github.com/BurntSushi/toml"
 	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/ec2"
 )
 
 type Config struct {
-	Aws     AwsConfig
-	DataDir string
-	SGroups map[string]SGroupConfig
-	Salt    SaltConfig
-	Tags    map[string]TagMap
-	Targets map[string]*Node
+	// Identifies the cluster this config describes. Every resource salter
+	// creates is tagged with it (see cluster.go), so that clusters sharing
+	// an account can't see or change each other's resources.
+	Cluster string `toml:"cluster"`
+
+	Aws       AwsConfig
+	DataDir   string
+	Nacls     map[string]NaclConfig
+	SGroups   map[string]SGroupConfig
+	Salt      SaltConfig
+	Snapshots SnapshotConfig
+	Tags      map[string]TagMap
+	Targets   map[string]*Node
+	Vpc       *VpcConfig
 
 	// This is the lsit of raw "Node" configuration elements in the config
 	// file. If a user defines a node named "node" and a count of 5 then
@@ -66,20 +76,116 @@ type Config struct {
 	// This will contain a list of all defined nodes, exploded based on
 	// the count variable.
 	Nodes map[string]*Node `toml:"-"`
+
+	// The availability zones of each region, looked up for zone spreading.
+	zones map[string][]string `toml:"-"`
 }
 
 type AwsConfig struct {
-	Ami      string `toml:"ami"`
-	Flavor   string `toml:"flavor"`
-	KeyName  string `toml:"keyname"`
-	RegionId string `toml:"region"`
-	SGroup   string `toml:"sgroup"`
-	Username string `toml:"ssh_username"`
-	Zone     string `toml:"zone"`
+	Ami       AmiSpec    `toml:"ami"`
+	Image     string     `toml:"image"`
+	Flavor    string     `toml:"flavor"`
+	KeyName   string     `toml:"keyname"`
+	RegionId  string     `toml:"region"`
+	SGroup    SGroupList `toml:"sgroup"`
+	Username  string     `toml:"ssh_username"`
+	Zone      string     `toml:"zone"`
+	Vpc       string     `toml:"vpc"`
+	Subnet    string     `toml:"subnet"`
+	PublicIp  *bool      `toml:"public_ip"`
+	PrivateIp string     `toml:"private_ip"`
+
+	// Peer the node's VPC with the master's so that it can reach the master
+	// on its private address. Both must be in the same region.
+	VpcPeering *bool `toml:"vpc_peering"`
+
+	// Instance attributes set at launch. Termination protection keeps
+	// teardown from terminating the node until it is disabled again. Flags
+	// are pointers so that a node can turn off one it would inherit.
+	IamProfile            string `toml:"iam_profile"`
+	TerminationProtection *bool  `toml:"termination_protection"`
+	EbsOptimized          *bool  `toml:"ebs_optimized"`
+	Monitoring            *bool  `toml:"monitoring"`
+	PlacementGroup        string `toml:"placement_group"`
+	Tenancy               string `toml:"tenancy"`
+	ShutdownBehavior      string `toml:"shutdown_behavior"`
+
+	// Spot instance configuration. Setting a spot_price implies the spot
+	// market; spot_timeout is the number of seconds to wait for the request
+	// to be fulfilled before giving up (or falling back to on-demand).
+	Market       string `toml:"market"`
+	SpotPrice    string `toml:"spot_price"`
+	SpotTimeout  int    `toml:"spot_timeout"`
+	SpotFallback *bool  `toml:"spot_fallback"`
+
+	// Counted nodes are spread round-robin across these zones, or across
+	// every zone in the region if zone is "spread".
+	Zones []string `toml:"zones"`
+
+	// This is an alias for "sgroup" so that lists read naturally in the
+	// config file. It is folded into SGroup as soon as the config is parsed.
+	SGroups SGroupList `toml:"sgroups"`
+}
+
+// A list of security group names. In the config file this can be given
+// either as a single string or as a list of strings.
+type SGroupList []string
+
+func (l *SGroupList) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*l = SGroupList{value}
+	case []interface{}:
+		*l = make(SGroupList, 0, len(value))
+		for _, item := range value {
+			name, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("security group names must be strings: %v",
+					item)
+			}
+			*l = append(*l, name)
+		}
+	default:
+		return fmt.Errorf("security groups must be a string or a list: %v",
+			data)
+	}
+	return nil
+}
+
+func (l SGroupList) contains(name string) bool {
+	for _, item := range l {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the "sgroups" alias into the SGroup field.
+func (aws *AwsConfig) foldSGroups() error {
+	if len(aws.SGroups) == 0 {
+		return nil
+	} else if len(aws.SGroup) != 0 {
+		return fmt.Errorf("sgroup and sgroups are mutually exclusive")
+	}
+	aws.SGroup = aws.SGroups
+	aws.SGroups = nil
+	return nil
 }
 
 type SGroupConfig struct {
 	Rules []string
+
+	// Outbound rules for VPC groups, using the same syntax as Rules.
+	Egress []string `toml:"egress"`
+}
+
+// The retention policy for the snapshot command. Keep is the number of
+// snapshot sets to keep per node and MaxAge the number of days to keep them
+// for; zero disables either limit.
+type SnapshotConfig struct {
+	Keep   int `toml:"keep"`
+	MaxAge int `toml:"max_age"`
 }
 
 type SaltConfig struct {
@@ -89,6 +195,67 @@ type SaltConfig struct {
 	UserDataFile string `toml:"userdata"`
 }
 
+// Returns the zone for the i'th (from 1) node of a count. Nodes with a
+// single zone keep it, while nodes with a list of zones, or a zone of
+// "spread", are assigned one round-robin.
+func (config *Config) spreadZone(node *Node, i uint) (string, error) {
+	if node.Zone != "spread" && (node.Zone != "" || len(node.Zones) == 0) {
+		return node.Zone, nil
+	} else if node.Subnet != "" {
+		return "", fmt.Errorf("subnet %s is in a single zone and can not "+
+			"be spread", node.Subnet)
+	}
+
+	zones := node.Zones
+	if len(zones) == 0 {
+		var err error
+		if zones, err = config.availabilityZones(node.RegionId); err != nil {
+			return "", err
+		}
+	}
+	return zones[(i-1)%uint(len(zones))], nil
+}
+
+// Zone and zones are alternatives, so whichever is set at the most specific
+// level wins. A list of zones is marked as spread before inheriting, so that
+// a zone inherited from a less specific level doesn't override it.
+func preferZones(aws *AwsConfig) {
+	if aws.Zone == "" && len(aws.Zones) > 0 {
+		aws.Zone = "spread"
+	}
+}
+
+// Returns the sorted names of the zones in a region. Zones are not filtered
+// by their state, so that the zone picked for each node of a count stays the
+// same when a zone becomes unavailable.
+func (config *Config) availabilityZones(regionId string) ([]string, error) {
+	if zones, found := config.zones[regionId]; found {
+		return zones, nil
+	}
+
+	conn := ec2.New(config.AwsAuth, aws.Regions[regionId])
+	resp, err := conn.DescribeAvailabilityZones(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list zones in %s: %s", regionId,
+			err)
+	}
+
+	zones := make([]string, 0, len(resp.Zones))
+	for _, zone := range resp.Zones {
+		zones = append(zones, zone.Name)
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no zones in %s", regionId)
+	}
+	sort.Strings(zones)
+
+	if config.zones == nil {
+		config.zones = make(map[string][]string)
+	}
+	config.zones[regionId] = zones
+	return zones, nil
+}
+
 // Loads the configuration from filename.
 func LoadConfig(filename string) (config *Config, err error) {
 	// This is the value we will return on success.
@@ -108,11 +275,47 @@ func LoadConfig(filename string) (config *Config, err error) {
 		return nil, err
 	}
 
+	if config.Cluster == "" {
+		return nil, fmt.Errorf("cluster is required")
+	}
+
+	// Allow "sgroups" to be used in place of "sgroup" everywhere.
+	if err = config.Aws.foldSGroups(); err != nil {
+		return nil, fmt.Errorf("aws: %s", err)
+	}
+	for id, node := range config.RawNodes {
+		if err = node.AwsConfig.foldSGroups(); err != nil {
+			return nil, fmt.Errorf("%s: %s", id, err)
+		}
+	}
+
+	// The managed network defaults to the default region.
+	if config.Vpc != nil {
+		if config.Vpc.RegionId == "" {
+			config.Vpc.RegionId = config.Aws.RegionId
+		}
+		if err = config.Vpc.validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Convert the RawNodes field into the Nodes field by expanding each
 	// node definition out into a fully exploded list of all nodes that are
 	// configured.
 	config.Nodes = make(map[string]*Node, len(config.RawNodes))
 	for id, node := range config.RawNodes {
+		// A fixed private IP can only ever be given to a single instance.
+		if node.Count > 0 && node.PrivateIp != "" {
+			return nil, fmt.Errorf("%s: private_ip can not be used with count",
+				id)
+		}
+
+		// As can an existing elastic IP.
+		if node.Count > 0 && node.Eip != "" && node.Eip != EIP_AUTO {
+			return nil, fmt.Errorf("%s: eip %s can not be used with count",
+				id, node.Eip)
+		}
+
 		// The easiest case here is that the node has no count. In this case
 		// the node name matches the id and there is no expansion.
 		if node.Count == 0 {
@@ -131,7 +334,11 @@ func LoadConfig(filename string) (config *Config, err error) {
 
 			// We also copy any of the AWS specific configuration into the
 			// node so it can pick up default values like key, or flavor.. etc.
+			preferZones(&nodeData.AwsConfig)
 			inheritFieldsIfEmpty(&nodeData.AwsConfig, &config.Aws)
+			if nodeData.Zone, err = config.spreadZone(nodeData, 1); err != nil {
+				return nil, fmt.Errorf("%s: %s", id, err)
+			}
 
 			// Add the Tags for this node.
 			node.Tags = config.Tags[id]
@@ -158,6 +365,8 @@ func LoadConfig(filename string) (config *Config, err error) {
 				// in the parent node definition we are processing.
 				*nodeData = *childData
 				inheritFieldsIfEmpty(nodeData, node)
+				preferZones(&nodeData.AwsConfig)
+				inheritFieldsIfEmpty(&nodeData.AwsConfig, &node.AwsConfig)
 			} else {
 				// Otherwise we can make a copy of the node being processed.
 				*nodeData = *node
@@ -177,8 +386,15 @@ func LoadConfig(filename string) (config *Config, err error) {
 
 			// We also copy any of the AWS specific configuration into the
 			// node so it can pick up default values like key, or flavor.. etc.
+			preferZones(&nodeData.AwsConfig)
 			inheritFieldsIfEmpty(&nodeData.AwsConfig, &config.Aws)
 
+			// The zone is picked from the node's position in the count so
+			// that a relaunched node lands back in the same zone.
+			if nodeData.Zone, err = config.spreadZone(nodeData, i); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+
 			// And finally we add it to the map of defined nodes.
 			nodeData.Name = name
 			nodeData.Count = 0
@@ -186,6 +402,76 @@ func LoadConfig(filename string) (config *Config, err error) {
 		}
 	}
 
+	// Validate the network placement of each node now that all the values
+	// have been inherited.
+	for name, node := range config.Nodes {
+		for _, volume := range node.Volumes {
+			if err := volume.validate(); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+
+		// Subnets of the managed network are referred to by name, which
+		// implies the network's VPC.
+		if config.Vpc != nil && config.Vpc.subnet(node.Subnet) != nil {
+			if node.Vpc == "" {
+				node.Vpc = config.Vpc.Name
+			}
+			if node.Vpc == config.Vpc.Name &&
+				node.RegionId != config.Vpc.RegionId {
+				return nil, fmt.Errorf("%s: network %s is in %s, not %s",
+					name, config.Vpc.Name, config.Vpc.RegionId, node.RegionId)
+			}
+		}
+
+		if node.Subnet != "" && node.Vpc == "" {
+			return nil, fmt.Errorf("%s: subnet %s requires a vpc", name,
+				node.Subnet)
+		} else if node.PrivateIp != "" && node.Subnet == "" {
+			return nil, fmt.Errorf("%s: private_ip requires a subnet", name)
+		} else if isTrue(node.PublicIp) && node.Subnet == "" {
+			return nil, fmt.Errorf("%s: public_ip requires a subnet", name)
+		}
+
+		switch node.Market {
+		case "":
+			if node.SpotPrice != "" {
+				node.Market = "spot"
+			}
+		case "ondemand":
+		case "spot":
+			if node.SpotPrice == "" {
+				return nil, fmt.Errorf("%s: the spot market requires a "+
+					"spot_price", name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown market: %s", name, node.Market)
+		}
+
+		switch node.Tenancy {
+		case "", "default", "dedicated":
+		default:
+			return nil, fmt.Errorf("%s: unknown tenancy: %s", name,
+				node.Tenancy)
+		}
+
+		switch node.ShutdownBehavior {
+		case "", "stop", "terminate":
+		default:
+			return nil, fmt.Errorf("%s: unknown shutdown_behavior: %s", name,
+				node.ShutdownBehavior)
+		}
+
+		// Spot requests can only carry some of the instance attributes.
+		if node.Market == "spot" && (isTrue(node.TerminationProtection) ||
+			isTrue(node.EbsOptimized) || node.Tenancy != "" ||
+			node.ShutdownBehavior != "") {
+			return nil, fmt.Errorf("%s: termination_protection, "+
+				"ebs_optimized, tenancy and shutdown_behavior can not be "+
+				"used with spot instances", name)
+		}
+	}
+
 	// Setup default salter configurations.
 	if config.Salt.Timeout == 0 {
 		config.Salt.Timeout = 60
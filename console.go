@@ -0,0 +1,110 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Fetches the console output of the target nodes, saves it in the data dir
+// and displays it.
+func console() error {
+	updateNodes(G_TARGETS, ARG_PARALLEL)
+	for _, node := range G_TARGETS {
+		if node.Instance == nil {
+			printf("%s: no console output; node does not exist\n", node.Name)
+			continue
+		}
+
+		output, filename, err := node.SaveConsoleOutput()
+		if err != nil {
+			errorf("%s: unable to get console output: %+v\n", node.Name, err)
+			continue
+		}
+
+		printf("==> %s (%s) <==\n%s\n", node.Name, filename, output)
+	}
+	return nil
+}
+
+// Retrieves and decodes the console output of the node's instance. EC2 only
+// refreshes the output every few minutes, so a node that just booted may not
+// have any yet.
+func (node *Node) ConsoleOutput() (string, error) {
+	resp, err := node.Conn().GetConsoleOutput(&ec2.GetConsoleOutput{
+		InstanceId: node.Instance.InstanceId})
+	if err != nil {
+		return "", err
+	}
+
+	output, err := base64.StdEncoding.DecodeString(resp.Output)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode output: %+v", err)
+	}
+	return string(output), nil
+}
+
+// Retrieves the console output of the node's instance and writes it to
+// <datadir>/console/<cluster>/<node>.log, returning the output and the
+// filename. The data dir is shared by every cluster using the account, which
+// may have nodes of the same name.
+func (node *Node) SaveConsoleOutput() (string, string, error) {
+	output, err := node.ConsoleOutput()
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(G_CONFIG.DataDir, "console", G_CONFIG.Cluster)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", "", err
+	}
+
+	filename := filepath.Join(dir, node.Name+".log")
+	err = ioutil.WriteFile(filename, []byte(output), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return output, filename, nil
+}
+
+// Saves the console output of a node that failed to launch so the cause can
+// be diagnosed after the fact.
+func captureConsole(node *Node) {
+	if node.Instance == nil {
+		return
+	}
+
+	_, filename, err := node.SaveConsoleOutput()
+	if err != nil {
+		errorf("%s: unable to get console output: %+v\n", node.Name, err)
+		return
+	}
+	printf("%s: console output saved to %s\n", node.Name, filename)
+}
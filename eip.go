@@ -0,0 +1,235 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// The instance tag that records the elastic IP associated with a node.
+const EIP_TAG = "EIP"
+
+// The elastic IP configuration of a node. In the config file this is either
+// "eip = true", in which case an address is allocated when the node is
+// launched and released when it is torn down, or the public IP or allocation
+// id of an existing address, which is only ever disassociated.
+type ElasticIp string
+
+const EIP_AUTO ElasticIp = "auto"
+
+func (e *ElasticIp) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case bool:
+		if value {
+			*e = EIP_AUTO
+		} else {
+			*e = ""
+		}
+	case string:
+		*e = ElasticIp(value)
+	default:
+		return fmt.Errorf("eip must be a boolean or an address: %v", data)
+	}
+	return nil
+}
+
+// Finds the address described by the config, or an empty address if a new
+// one should be allocated.
+func (node *Node) findAddress(eip ElasticIp) (*ec2.Address, error) {
+	if eip == EIP_AUTO {
+		return &ec2.Address{}, nil
+	}
+
+	var resp *ec2.DescribeAddressesResp
+	var err error
+	if strings.HasPrefix(string(eip), "eipalloc-") {
+		resp, err = node.Conn().Addresses(nil, []string{string(eip)}, nil)
+	} else {
+		resp, err = node.Conn().Addresses([]string{string(eip)}, nil, nil)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to find address %s: %+v", eip, err)
+	} else if len(resp.Addresses) != 1 {
+		return nil, fmt.Errorf("address %s not found", eip)
+	}
+	return &resp.Addresses[0], nil
+}
+
+// Associates the node's elastic IP with its instance, allocating an address
+// first if necessary. The address is recorded in the EIP tag of the
+// instance so that teardown can find it again. An address allocated here is
+// released again if it can not be tagged and associated, since nothing else
+// would ever find it.
+func (node *Node) AssociateAddress() error {
+	if node.Eip == "" {
+		return nil
+	}
+
+	// Nothing to do if a previous launch already associated the address.
+	if ip, found := findTag(node.Instance.Tags, EIP_TAG); found &&
+		ip == node.Instance.PublicIpAddress {
+		return nil
+	}
+
+	address, err := node.findAddress(node.Eip)
+	if err != nil {
+		return err
+	}
+
+	// Addresses can't be tagged, so an address in use elsewhere, possibly by
+	// another cluster, is never taken over.
+	if address.InstanceId != "" &&
+		address.InstanceId != node.Instance.InstanceId {
+		return fmt.Errorf("address %s is associated with %s",
+			address.PublicIp, address.InstanceId)
+	}
+
+	// Addresses for VPC instances are referenced by allocation id, while
+	// EC2-Classic addresses are referenced by their public IP.
+	vpc := node.Instance.VpcId != ""
+	allocated := address.PublicIp == ""
+	if allocated {
+		domain := "standard"
+		if vpc {
+			domain = "vpc"
+		}
+
+		allocResp, err := node.Conn().AllocateAddress(
+			&ec2.AllocateAddress{Domain: domain})
+		if err != nil {
+			return fmt.Errorf("unable to allocate address: %+v", err)
+		}
+		address.PublicIp = allocResp.PublicIp
+		address.AllocationId = allocResp.AllocationId
+		printf("%s: allocated %s\n", node.Name, address.PublicIp)
+	}
+
+	// Tag before associating so that the address is never in use without
+	// being recorded.
+	err = node.tagAndAssociate(address, vpc)
+	if err != nil {
+		if !allocated {
+			return err
+		} else if relErr := node.releaseAllocation(address); relErr != nil {
+			errorf("%s: unable to release %s; %+v\n", node.Name,
+				address.PublicIp, relErr)
+		} else {
+			printf("%s: released %s\n", node.Name, address.PublicIp)
+		}
+		return err
+	}
+	printf("%s: associated %s\n", node.Name, address.PublicIp)
+
+	// Refresh the instance so that it reflects the new public address.
+	return node.Update()
+}
+
+// Returns the elastic IP recorded on the node's instance, which a stopped
+// EC2-Classic instance gets back when it is started.
+func (node *Node) eipTag() (string, bool) {
+	if node.Instance == nil {
+		return "", false
+	}
+	return findTag(node.Instance.Tags, EIP_TAG)
+}
+
+// Records the address in the instance's EIP tag and associates it.
+func (node *Node) tagAndAssociate(address *ec2.Address, vpc bool) error {
+	_, err := node.Conn().CreateTags([]string{node.Instance.InstanceId},
+		withClusterTag(ec2.Tag{Key: EIP_TAG, Value: address.PublicIp}))
+	if err != nil {
+		return fmt.Errorf("unable to tag %s with %s: %+v", node.Name,
+			address.PublicIp, err)
+	}
+
+	assoc := ec2.AssociateAddress{InstanceId: node.Instance.InstanceId}
+	if vpc {
+		assoc.AllocationId = address.AllocationId
+	} else {
+		assoc.PublicIp = address.PublicIp
+	}
+	_, err = node.Conn().AssociateAddress(&assoc)
+	if err != nil {
+		return fmt.Errorf("unable to associate %s: %+v", address.PublicIp,
+			err)
+	}
+	return nil
+}
+
+// Gives an address back to AWS; VPC addresses are released by allocation id
+// and EC2-Classic ones by their public IP.
+func (node *Node) releaseAllocation(address *ec2.Address) error {
+	var err error
+	if address.AllocationId != "" {
+		_, err = node.Conn().ReleaseAddress(address.AllocationId)
+	} else {
+		_, err = node.Conn().ReleasePublicAddress(address.PublicIp)
+	}
+	return err
+}
+
+// Disassociates the elastic IP recorded on the given instance of the node,
+// which may already have been terminated. Addresses that salter allocated
+// itself (eip = true) are also released.
+func (node *Node) ReleaseAddress(instance *ec2.Instance) error {
+	ip, found := findTag(instance.Tags, EIP_TAG)
+	if !found {
+		return nil
+	}
+
+	resp, err := node.Conn().Addresses([]string{ip}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to find address %s: %+v", ip, err)
+	} else if len(resp.Addresses) != 1 {
+		// Already released.
+		return nil
+	}
+	address := resp.Addresses[0]
+
+	if address.InstanceId == instance.InstanceId {
+		if address.AssociationId != "" {
+			_, err = node.Conn().DisassociateAddress(address.AssociationId)
+		} else {
+			_, err = node.Conn().DisassociateAddressClassic(address.PublicIp)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to disassociate %s: %+v", ip, err)
+		}
+		printf("%s: disassociated %s\n", node.Name, ip)
+	}
+
+	if node.Eip != EIP_AUTO {
+		return nil
+	}
+
+	err = node.releaseAllocation(&address)
+	if err != nil {
+		return fmt.Errorf("unable to release %s: %+v", ip, err)
+	}
+	printf("%s: released %s\n", node.Name, ip)
+	return nil
+}
@@ -0,0 +1,305 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/ty/fun"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Tags applied to baked images.
+const (
+	IMAGE_ROLE_TAG    = "Role"
+	IMAGE_SALT_TAG    = "SaltTree"
+	IMAGE_CREATED_TAG = "Created"
+)
+
+// Commands run on a node before it is imaged so that instances launched from
+// the image come up as new minions. The originals are kept so that the node
+// can be restored afterwards. The cloud-init state is left alone: instances
+// launched from the image have a new instance id, so cloud-init runs their
+// user data anyway, while the source node must not run it again when
+// CreateImage reboots it.
+var cleanIdentityCmds = []string{
+	"/usr/bin/sudo stop salt-minion",
+	"/usr/bin/sudo cp /etc/hosts /etc/hosts.salter",
+	"/usr/bin/sudo sed -i -e '/\tsaltmaster$/d' -e '/^127.0.1.1\t/d' /etc/hosts",
+	"/usr/bin/sudo rm -rf /etc/salt/pki/minion /etc/salt/minion_id",
+}
+
+// Images are identified by the roles of the node they were baked from. The
+// roles are sorted so that their order in the config doesn't matter.
+func imageRole(roles []string) string {
+	sorted := make([]string, len(roles))
+	copy(sorted, roles)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// Bakes an AMI from a highstated node.
+func image() error {
+	target := fun.Keys(G_TARGETS).([]string)
+	if len(target) != 1 {
+		errorf("Only one node may be used with the image command.\n")
+		return fmt.Errorf("More than one target")
+	}
+
+	node := G_TARGETS[target[0]]
+	for _, role := range node.Roles {
+		if role == "saltmaster" {
+			errorf("Images can not be made from the salt master.\n")
+			return fmt.Errorf("%s is the master", node.Name)
+		}
+	}
+
+	err := node.Update()
+	if err != nil {
+		errorf("Unable to retrieve status of %s from AWS: %+v\n",
+			node.Name, err)
+		return err
+	} else if !node.IsRunning() {
+		errorf("Node %s is not running.\n", node.Name)
+		return fmt.Errorf("%s is not running", node.Name)
+	}
+
+	role := imageRole(node.Roles)
+	hash := saltTreeHash()
+	created := time.Now().UTC()
+
+	// Strip the minion identity from the node. From here on the node has to
+	// be put back into the cluster however the imaging goes.
+	restored := false
+	restore := func() {
+		if restored {
+			return
+		}
+		restored = true
+		if err := restoreIdentity(node); err != nil {
+			errorf("Failed to restore %s: %+v\n", node.Name, err)
+		}
+	}
+	defer restore()
+
+	printf("%s: cleaning minion identity\n", node.Name)
+	for _, cmd := range cleanIdentityCmds {
+		if err := node.SshRun(cmd); err != nil {
+			errorf("Failed to clean %s (%s): %+v\n", node.Name, cmd, err)
+			return err
+		}
+	}
+	node.SshClose()
+
+	// Create the image. This reboots the node so that the file systems are
+	// consistent.
+	name := fmt.Sprintf("salter-%s-%s", strings.Replace(role, ",", "-", -1),
+		created.Format("20060102-150405"))
+	imageResp, err := node.Conn().CreateImage(&ec2.CreateImage{
+		InstanceId:  node.Instance.InstanceId,
+		Name:        name,
+		Description: fmt.Sprintf("%s baked from %s", role, node.Name)})
+	if err != nil {
+		errorf("Failed to create image of %s: %+v\n", node.Name, err)
+		return err
+	}
+	printf("%s: creating image %s (%s)\n", node.Name, name, imageResp.ImageId)
+
+	tags := withClusterTag(
+		ec2.Tag{Key: "Name", Value: name},
+		ec2.Tag{Key: IMAGE_ROLE_TAG, Value: role},
+		ec2.Tag{Key: IMAGE_SALT_TAG, Value: hash},
+		ec2.Tag{Key: IMAGE_CREATED_TAG, Value: created.Format(time.RFC3339)},
+	)
+	_, err = node.Conn().CreateTags([]string{imageResp.ImageId}, tags)
+	if err != nil {
+		errorf("Failed to tag image %s: %+v\n", imageResp.ImageId, err)
+		return err
+	}
+
+	err = waitForImage(node.Conn(), imageResp.ImageId)
+	if err != nil {
+		errorf("Image %s failed: %+v\n", imageResp.ImageId, err)
+		return err
+	}
+	printf("%s: image %s is available\n", node.Name, imageResp.ImageId)
+
+	// Put the source node back into the cluster.
+	restore()
+
+	// Copy the image into every other region that has nodes using it.
+	regions := make(map[string]bool)
+	for _, n := range G_CONFIG.Nodes {
+		if n.Image != "" && imageRole(strings.Split(n.Image, ",")) == role &&
+			n.RegionId != node.RegionId {
+			regions[n.RegionId] = true
+		}
+	}
+	for regionId, _ := range regions {
+		region, err := GetRegion(regionId)
+		if err != nil {
+			errorf("Failed to get the region data for %s: %+v\n", regionId,
+				err)
+			continue
+		}
+
+		copyResp, err := region.Conn.CopyImage(&ec2.CopyImage{
+			SourceRegion:  node.RegionId,
+			SourceImageId: imageResp.ImageId,
+			Name:          name,
+			Description:   fmt.Sprintf("%s baked from %s", role, node.Name)})
+		if err != nil {
+			errorf("Failed to copy %s to %s: %+v\n", imageResp.ImageId,
+				regionId, err)
+			continue
+		}
+
+		// Tags are not copied with the image.
+		_, err = region.Conn.CreateTags([]string{copyResp.ImageId}, tags)
+		if err != nil {
+			errorf("Failed to tag image %s: %+v\n", copyResp.ImageId, err)
+			continue
+		}
+		printf("%s: copying image to %s (%s)\n", node.Name, regionId,
+			copyResp.ImageId)
+	}
+
+	return nil
+}
+
+// Puts back the identity removed by cleanIdentityCmds once the node has
+// come back from the image reboot.
+func restoreIdentity(node *Node) error {
+	err := waitForRunning(node)
+	if err != nil {
+		return err
+	}
+
+	err = node.SshRun("/usr/bin/sudo mv /etc/hosts.salter /etc/hosts")
+	if err != nil {
+		return err
+	}
+
+	master := G_CONFIG.findNodeByRole("saltmaster")
+	if master == nil {
+		return fmt.Errorf("no saltmaster role")
+	} else if err = master.Update(); err != nil {
+		return err
+	} else if !master.IsRunning() {
+		return fmt.Errorf("%s is not running", master.Name)
+	}
+
+	node.SshRun("/usr/bin/sudo mkdir -p /etc/salt/pki/minion")
+	distributeKeys(node, master)
+	return nil
+}
+
+// Polls AWS until the image is available.
+func waitForImage(conn *ec2.EC2, imageId string) error {
+	for {
+		resp, err := conn.Images([]string{imageId}, nil)
+		if err != nil {
+			return fmt.Errorf("AWS image update failed - %+v", err)
+		}
+
+		if len(resp.Images) == 1 {
+			switch resp.Images[0].State {
+			case "available":
+				return nil
+			case "pending":
+			default:
+				return fmt.Errorf("unexpected image state - %s: %s",
+					resp.Images[0].State, resp.Images[0].StateReason)
+			}
+		}
+
+		time.Sleep(15 * time.Second)
+	}
+}
+
+// Identifies the salt tree an image was baked with. This is the git commit
+// of the salt root if it is a git checkout, otherwise a hash of its
+// contents.
+func saltTreeHash() string {
+	root := G_CONFIG.Salt.RootDir
+	out, err := exec.Command("git", "-C", root, "rev-parse", "HEAD").Output()
+	if err == nil {
+		hash := strings.TrimSpace(string(out))
+		status, err := exec.Command("git", "-C", root, "status",
+			"--porcelain").Output()
+		if err == nil && len(status) > 0 {
+			hash += "-dirty"
+		}
+		return hash
+	}
+
+	h := sha1.New()
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		io.WriteString(h, path)
+		io.Copy(h, f)
+		return nil
+	})
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Finds the most recently baked image for a role in the given region. This
+// returns nil if no image has been baked for the role yet.
+func findRoleImage(conn *ec2.EC2, role string) (*ec2.Image, error) {
+	filter := ec2.NewFilter()
+	filter.Add("tag:"+IMAGE_ROLE_TAG, role)
+	addClusterFilter(filter)
+	filter.Add("state", "available")
+	resp, err := conn.ImagesByOwners(nil, []string{"self"}, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *ec2.Image
+	latestCreated := ""
+	for i, img := range resp.Images {
+		created, _ := findTag(img.Tags, IMAGE_CREATED_TAG)
+		if latest == nil || created > latestCreated {
+			latest = &resp.Images[i]
+			latestCreated = created
+		}
+	}
+	return latest, nil
+}
@@ -78,21 +78,7 @@ func LoadKey(keyName, keyDir, remoteFingerprint string) (*Key, error) {
 				filename, info.Mode().Perm())
 		}
 
-		// Read the whole PEM file
-		data, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return nil, err
-		}
-
-		// Decode from PEM
-		block, _ := pem.Decode(data)
-		if block == nil {
-			return nil, fmt.Errorf("Failed to decode key from %s: %s",
-				filename, err)
-		}
-
-		// Decode from DER
-		privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		privKey, err := readPrivateKey(filename)
 		if err != nil {
 			return nil, err
 		}
@@ -129,6 +115,33 @@ func LoadKey(keyName, keyDir, remoteFingerprint string) (*Key, error) {
 	}
 }
 
+// Read a PKCS-1 PEM encoded RSA key from a file
+func readPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	// Read the whole PEM file
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode from PEM
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode key from %s", filename)
+	}
+
+	// Decode from DER
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Format the public half of a RSA key as an OpenSSH authorized_keys line
+func authorizedKey(privKey *rsa.PrivateKey) (string, error) {
+	pubKey, err := ssh.NewPublicKey(&(privKey.PublicKey))
+	if err != nil {
+		return "", err
+	}
+	return string(ssh.MarshalAuthorizedKey(pubKey)), nil
+}
+
 // Generate a new RSA key, serializing to a PKCS-1 PEM file
 func generateKey(filename string, bits int) error {
 	privKey, err := rsa.GenerateKey(rand.Reader, bits)
@@ -0,0 +1,315 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/ty/fun"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// The size of keys generated by "keys import".
+const KEY_BITS = 2048
+
+// Manages the EC2 key pairs of the regions used by the config. The first
+// argument is the action (list, create, import or delete) and the rest are
+// key names, which default to the keys used by the config's nodes. Keys are
+// only deleted by name, since deleting a key in use cuts off SSH access to
+// every node launched with it.
+func keys() error {
+	action := "list"
+	if len(G_ARGS) > 0 {
+		action = G_ARGS[0]
+	}
+
+	// Work out which regions each key needs to be in
+	used := configKeyRegions()
+	if action == "list" {
+		return listKeys(used)
+	}
+
+	names := G_ARGS
+	if len(names) > 0 {
+		names = names[1:]
+	}
+	if len(names) == 0 && action == "delete" {
+		errorf("usage: salter keys delete name...\n")
+		return fmt.Errorf("no keys to delete")
+	} else if action == "delete" && !confirm(fmt.Sprintf("Delete key "+
+		"pairs %s and their local files?", strings.Join(names, ", "))) {
+		return nil
+	} else if len(names) == 0 {
+		names = fun.Keys(used).([]string)
+		sort.Strings(names)
+	}
+
+	failed := 0
+	for _, name := range names {
+		regions := used[name]
+		if len(regions) == 0 {
+			regions = configRegions()
+		}
+
+		var err error
+		switch action {
+		case "create":
+			err = createKey(name, regions)
+		case "import":
+			err = importKey(name, regions)
+		case "delete":
+			err = deleteKey(name, regions)
+		default:
+			errorf("usage: salter keys [list|create|import|delete] [name...]\n")
+			return fmt.Errorf("unknown keys action %s", action)
+		}
+
+		if err != nil {
+			errorf("%s: %+v\n", name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d keys failed to %s", failed, len(names),
+			action)
+	}
+	return nil
+}
+
+// Returns the sorted list of regions used by the config's nodes.
+func configRegions() []string {
+	set := make(map[string]bool)
+	for _, node := range G_CONFIG.Nodes {
+		set[node.RegionId] = true
+	}
+	regions := fun.Keys(set).([]string)
+	sort.Strings(regions)
+	return regions
+}
+
+// Returns the regions each key named in the config is used in.
+func configKeyRegions() map[string][]string {
+	used := make(map[string][]string)
+	for _, regionId := range configRegions() {
+		seen := make(map[string]bool)
+		for _, node := range G_CONFIG.Nodes {
+			if node.RegionId == regionId && !seen[node.KeyName] {
+				used[node.KeyName] = append(used[node.KeyName], regionId)
+				seen[node.KeyName] = true
+			}
+		}
+	}
+	return used
+}
+
+// The local copy of a key lives in the data dir.
+func keyFilename(name string) string {
+	return filepath.Join(G_CONFIG.DataDir, name+".pem")
+}
+
+// Lists the key pairs in each region along with whether they are used by
+// the config and the state of the local copy of the key.
+func listKeys(used map[string][]string) error {
+	for _, regionId := range configRegions() {
+		region, _ := GetRegion(regionId)
+		resp, err := region.Conn.KeyPairs(nil, nil)
+		if err != nil {
+			errorf("%s: unable to list key pairs: %+v\n", regionId, err)
+			return err
+		}
+
+		for _, keyPair := range resp.Keys {
+			inUse := ""
+			for _, r := range used[keyPair.Name] {
+				if r == regionId {
+					inUse = "used"
+				}
+			}
+
+			fingerprint := strings.Replace(keyPair.Fingerprint, ":", "", -1)
+			status := "ok"
+			if !FileExists(keyFilename(keyPair.Name)) {
+				status = "no local file"
+			} else if _, err := LoadKey(keyPair.Name, G_CONFIG.DataDir,
+				fingerprint); err != nil {
+				status = err.Error()
+			}
+
+			printf("%s\t%s\t%s\t%s\t%s\n", regionId, keyPair.Name,
+				keyPair.Fingerprint, inUse, status)
+		}
+	}
+	return nil
+}
+
+// Returns true if the key pair exists in the region.
+func keyPairExists(name, regionId string) (bool, error) {
+	region, _ := GetRegion(regionId)
+	resp, err := region.Conn.KeyPairs(nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	for _, keyPair := range resp.Keys {
+		if keyPair.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Has EC2 generate the key pair in the first region and saves the private
+// key locally. The other regions have the public half imported, since a key
+// name can only map to a single local file.
+func createKey(name string, regions []string) error {
+	filename := keyFilename(name)
+	if FileExists(filename) {
+		return fmt.Errorf("%s already exists; use import to upload it",
+			filename)
+	}
+
+	region, _ := GetRegion(regions[0])
+	resp, err := region.Conn.CreateKeyPair(name)
+	if err != nil {
+		return fmt.Errorf("unable to create key pair in %s: %+v",
+			regions[0], err)
+	}
+
+	err = ioutil.WriteFile(filename, []byte(resp.KeyMaterial), 0600)
+	if err != nil {
+		return err
+	}
+	printf("%s: created in %s and saved to %s\n", name, regions[0], filename)
+
+	return importKey(name, regions[1:])
+}
+
+// Imports the public half of the local key into each region that does not
+// have it yet, generating the local key first if there isn't one.
+func importKey(name string, regions []string) error {
+	filename := keyFilename(name)
+	if !FileExists(filename) {
+		err := generateKey(filename, KEY_BITS)
+		if err != nil {
+			return fmt.Errorf("unable to generate %s: %+v", filename, err)
+		}
+		printf("%s: generated %s\n", name, filename)
+	}
+
+	privKey, err := readPrivateKey(filename)
+	if err != nil {
+		return err
+	}
+
+	pubKey, err := authorizedKey(privKey)
+	if err != nil {
+		return err
+	}
+
+	for _, regionId := range regions {
+		exists, err := keyPairExists(name, regionId)
+		if err != nil {
+			return err
+		} else if exists {
+			printf("%s: already exists in %s\n", name, regionId)
+			continue
+		}
+
+		region, _ := GetRegion(regionId)
+		_, err = region.Conn.ImportKeyPair(name, pubKey)
+		if err != nil {
+			return fmt.Errorf("unable to import key pair into %s: %+v",
+				regionId, err)
+		}
+		printf("%s: imported into %s\n", name, regionId)
+	}
+	return nil
+}
+
+// Deletes the key pair from each region and then the local copy.
+func deleteKey(name string, regions []string) error {
+	// Key pairs can't be tagged, so a key is only deleted once no instance of
+	// another cluster uses it.
+	for _, regionId := range regions {
+		err := checkKeyUsers(name, regionId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, regionId := range regions {
+		region, _ := GetRegion(regionId)
+		_, err := region.Conn.DeleteKeyPair(name)
+		if err != nil {
+			return fmt.Errorf("unable to delete key pair from %s: %+v",
+				regionId, err)
+		}
+		printf("%s: deleted from %s\n", name, regionId)
+	}
+
+	filename := keyFilename(name)
+	if FileExists(filename) {
+		err := os.Remove(filename)
+		if err != nil {
+			return err
+		}
+		printf("%s: deleted %s\n", name, filename)
+	}
+	return nil
+}
+
+// Checks that every live instance launched with the key belongs to this
+// cluster.
+func checkKeyUsers(name, regionId string) error {
+	region, err := GetRegion(regionId)
+	if err != nil {
+		return err
+	}
+
+	filter := ec2.NewFilter()
+	filter.Add("key-name", name)
+	filter.Add("instance-state-code",
+		fmt.Sprint(STATE_PENDING), fmt.Sprint(STATE_RUNNING),
+		fmt.Sprint(STATE_STOPPING), fmt.Sprint(STATE_STOPPED))
+	resp, err := region.Conn.Instances(nil, filter)
+	if err != nil {
+		return fmt.Errorf("unable to list instances in %s: %+v", regionId,
+			err)
+	}
+
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			err = checkCluster(instance.InstanceId, instance.Tags)
+			if err != nil {
+				return fmt.Errorf("key is in use in %s: %+v", regionId, err)
+			}
+		}
+	}
+	return nil
+}
@@ -114,6 +114,23 @@ func ensureMaster() *Node {
 	// Wait for master node be up and ready
 	err = waitForRunning(masterNode)
 	if err != nil {
+		errorf("Failed to launch %s: %+v\n", masterNode.Name, err)
+		captureConsole(masterNode)
+		return nil
+	}
+
+	// Attach any persistent volumes
+	err = masterNode.AttachVolumes()
+	if err != nil {
+		errorf("Failed to attach volumes to %s: %+v\n", masterNode.Name, err)
+		return nil
+	}
+
+	// Associate the elastic IP, if one is configured
+	err = masterNode.AssociateAddress()
+	if err != nil {
+		errorf("Failed to associate address with %s: %+v\n",
+			masterNode.Name, err)
 		return nil
 	}
 
@@ -133,7 +150,15 @@ func launchNode(node *Node, masterNode *Node) {
 		return
 	}
 
-	err = node.Start(masterNode.Instance.PrivateIpAddress)
+	// Minions in another region or network reach the master by a different
+	// address than those next to it.
+	masterIp, err := masterAddress(node, masterNode)
+	if err != nil {
+		errorf("Failed to start %s: %+v\n", node.Name, err)
+		return
+	}
+
+	err = node.Start(masterIp)
 	if err != nil {
 		errorf("Failed to start %s: %+v\n", node.Name, err)
 		return
@@ -144,6 +169,21 @@ func launchNode(node *Node, masterNode *Node) {
 	err = waitForRunning(node)
 	if err != nil {
 		errorf("Failed to launch %s: %+v\n", node.Name, err)
+		captureConsole(node)
+		return
+	}
+
+	// Attach any persistent volumes
+	err = node.AttachVolumes()
+	if err != nil {
+		errorf("Failed to attach volumes to %s: %+v\n", node.Name, err)
+		return
+	}
+
+	// Associate the elastic IP, if one is configured
+	err = node.AssociateAddress()
+	if err != nil {
+		errorf("Failed to associate address with %s: %+v\n", node.Name, err)
 		return
 	}
 
@@ -170,13 +210,18 @@ func waitForRunning(node *Node) error {
 		err := node.Update()
 		if err != nil {
 			return fmt.Errorf("AWS status update failed - %+v", err)
+		} else if node.Instance == nil {
+			return fmt.Errorf("instance has gone away")
 		}
 
 		switch node.Instance.State.Name {
 		case "running":
+			err = waitForStatusChecks(node)
+			if err != nil {
+				return err
+			}
 			return waitForSsh(node)
 		case "pending":
-			continue
 		default:
 			// Not running or pending; indicates a failed launch
 			return fmt.Errorf("unexpected instance state - %s",
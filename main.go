@@ -89,12 +89,20 @@ type Command struct {
 	// If this is true then -a is default if no other arguments are
 	// passed.
 	DefaultAll bool
+
+	// Does this command take arguments after the command name?
+	Args bool
+
+	// Does this command need the nodes' vpc and subnet ids? Nodes may refer
+	// to the managed network by name, which is then looked up on AWS.
+	Network bool
 }
 
 var G_CONFIG *Config
 var G_TARGETS map[string]*Node
 var G_DIR string
 var G_COMMANDS map[string]Command
+var G_ARGS []string
 
 var ARG_TARGETS Targets
 var ARG_CONFIG_FILE string
@@ -105,6 +113,9 @@ var ARG_TAGS TagMap
 var ARG_GLOB bool
 var ARG_REGEX bool
 var ARG_PARALLEL int = 10
+var ARG_SNAPSHOT_SET string
+var ARG_RECONCILE bool
+var ARG_YES bool
 
 // Displays usage information for the flags library.
 func usage() error {
@@ -137,11 +148,22 @@ func init() {
 
 	// Setup the map of sub commands.
 	G_COMMANDS = map[string]Command{
+		"adopt": Command{
+			Fn:      adopt,
+			Usage:   "bring existing instances under management (node=instance)",
+			Args:    true,
+			Network: true,
+		},
 		"bootstrap": Command{
 			Fn:    bootstrap,
 			Usage: "Upload Salt configuration and highstate master.",
 			Nodes: true,
 		},
+		"console": Command{
+			Fn:    console,
+			Usage: "save and display the console output of instances",
+			Nodes: true,
+		},
 		"csshx": Command{
 			Fn:    csshx,
 			Usage: "open a series of SSH sessions to EC2 instances via csshX",
@@ -162,26 +184,78 @@ func init() {
 			Usage:  "invoke Salt highstate on the Salt master",
 			Target: true,
 		},
+		"health": Command{
+			Fn:    health,
+			Usage: "display EC2 status checks and events for instances",
+			Nodes: true,
+		},
 		"hosts": Command{
 			Fn:         hosts,
 			Usage:      "generate a list of live nodes on EC2",
 			Nodes:      true,
 			DefaultAll: true,
 		},
+		"image": Command{
+			Fn:    image,
+			Usage: "bake an AMI for a node's roles from a highstated node",
+			Nodes: true,
+		},
 		"info": Command{
 			Fn:         info,
-			Usage:      "display internal/external IP addresses for nodes",
+			Usage:      "display IP addresses and state for nodes",
 			Nodes:      true,
 			DefaultAll: true,
 		},
+		"keys": Command{
+			Fn:    keys,
+			Usage: "list, create, import or delete EC2 key pairs",
+			Args:  true,
+		},
 		"launch": Command{
-			Fn:    launch,
-			Usage: "launch instances on EC2",
+			Fn:      launch,
+			Usage:   "launch instances on EC2",
+			Nodes:   true,
+			Network: true,
+		},
+		"nacls": Command{
+			Fn:    nacls,
+			Usage: "create and associate network acls from configuration",
+		},
+		"network": Command{
+			Fn:    network,
+			Usage: "create, show or teardown the network in [vpc]",
+			Args:  true,
+		},
+		"orphans": Command{
+			Fn:    orphans,
+			Usage: "list (or terminate) instances no longer in the config",
+			Args:  true,
+		},
+		"reboot": Command{
+			Fn:    reboot,
+			Usage: "reboot instances and wait for their minions",
 			Nodes: true,
 		},
+		"resize": Command{
+			Fn:    resize,
+			Usage: "change the flavor of instances to match the config",
+			Nodes: true,
+		},
+		"restore": Command{
+			Fn:      restore,
+			Usage:   "launch instances with volumes from a snapshot set",
+			Nodes:   true,
+			Network: true,
+		},
 		"sgroups": Command{
-			Fn:    sgroups,
-			Usage: "generate security groups from configuration",
+			Fn:      sgroups,
+			Usage:   "generate security groups from configuration",
+			Nodes:   true,
+			Network: true,
+		},
+		"snapshot": Command{
+			Fn:    snapshot,
+			Usage: "snapshot EBS volumes and prune old snapshots",
 			Nodes: true,
 		},
 		"ssh": Command{
@@ -189,6 +263,16 @@ func init() {
 			Usage: "open a SSH session to a EC2 instance",
 			Nodes: true,
 		},
+		"start": Command{
+			Fn:    start,
+			Usage: "start stopped instances and wait for their minions",
+			Nodes: true,
+		},
+		"stop": Command{
+			Fn:    stop,
+			Usage: "stop running instances, keeping their volumes",
+			Nodes: true,
+		},
 		"tag": Command{
 			Fn:    tag,
 			Usage: "(re)apply tags to each AWS node",
@@ -238,12 +322,18 @@ func main() {
 		"Use globbing with the -n parameter to select nodes")
 	flag.BoolVar(&ARG_REGEX, "r", false,
 		"Use regexes with the -n parameter to select nodes")
+	flag.StringVar(&ARG_SNAPSHOT_SET, "snapshot", "",
+		"Snapshot set to restore (defaults to the latest)")
+	flag.BoolVar(&ARG_RECONCILE, "reconcile", false,
+		"Remove security group rules or nacl entries not in the config")
+	flag.BoolVar(&ARG_YES, "y", false,
+		"Answer yes to all confirmation prompts")
 
 	// Parse it up
 	flag.Parse()
 
 	// If parse failed, bail
-	if !flag.Parsed() || flag.NArg() != 1 {
+	if !flag.Parsed() || flag.NArg() < 1 {
 		usage()
 		os.Exit(1)
 	}
@@ -257,6 +347,12 @@ func main() {
 		os.Exit(-1)
 	}
 
+	// Any remaining arguments belong to the command.
+	G_ARGS = flag.Args()[1:]
+	if !cmd.Args && len(G_ARGS) != 0 {
+		fatalf("%s does not take arguments.\n", cmdName)
+	}
+
 	// See if the -s flag was used properly.
 	if cmd.Target && ARG_SALT_TARGETS == "" {
 		fatalf("-s can not contain an empty string.\n")
@@ -291,6 +387,16 @@ func main() {
 		fatalf("-g is not valid with %s.\n", cmdName)
 	}
 
+	// See if the -snapshot flag was used properly.
+	if ARG_SNAPSHOT_SET != "" && cmdName != "restore" {
+		fatalf("-snapshot is not valid with %s.\n", cmdName)
+	}
+
+	// See if the -reconcile flag was used properly.
+	if ARG_RECONCILE && cmdName != "sgroups" && cmdName != "nacls" {
+		fatalf("-reconcile is not valid with %s.\n", cmdName)
+	}
+
 	// See if the -t flag was used properly.
 	if cmd.Tags && len(ARG_TAGS) == 0 {
 		fatalf("%s requires tags to add (-t).\n", cmdName)
@@ -344,7 +450,19 @@ func main() {
 		}
 	}
 
-	cmd.Fn()
+	// Nodes may refer to the managed network by name.
+	if cmd.Network {
+		if err := G_CONFIG.resolveNetwork(); err != nil {
+			fatalf("Failed to resolve the network: %s\n", err)
+		}
+	}
+
+	// A failed command exits non-zero so that scripts can tell something
+	// went wrong.
+	if err := cmd.Fn(); err != nil {
+		errorf("%s failed: %+v\n", cmdName, err)
+		os.Exit(1)
+	}
 }
 
 func sshto() error {
@@ -377,7 +495,7 @@ func sshto() error {
 		"-o", "UserKnownHostsFile=/dev/null",
 		"-o", "ForwardAgent=yes",
 		"-l", G_CONFIG.Aws.Username,
-		node.Instance.DNSName,
+		node.Address(),
 	}
 
 	env := []string{
@@ -387,7 +505,7 @@ func sshto() error {
 	printf("Connecting to %s (%s)...\n", node.Name, node.Instance.InstanceId)
 	closeFrom(3)
 	err = syscall.Exec("/usr/bin/ssh", args, env)
-	fmt.Println("Failed to execute: %s", err)
+	errorf("Failed to execute: %s\n", err)
 	syscall.Exit(1)
 	return nil
 }
@@ -440,7 +558,7 @@ func csshx() error {
 
 	for _, name := range names {
 		printf(" * %s\n", name)
-		args = append(args, G_TARGETS[name].Instance.PublicIpAddress)
+		args = append(args, G_TARGETS[name].Address())
 	}
 
 	env := []string{
@@ -449,7 +567,7 @@ func csshx() error {
 	}
 
 	err = syscall.Exec(csshPath, args, env)
-	fmt.Println("Failed to execute: %s", err)
+	errorf("Failed to execute: %s\n", err)
 	syscall.Exit(1)
 	return nil
 }
@@ -465,7 +583,7 @@ func hosts() error {
 	// Print each entry
 	for _, name := range names {
 		node := G_TARGETS[name]
-		if node.Instance != nil {
+		if node.IsRunning() {
 			printf("%s\t%s\n", node.Instance.PublicIpAddress, node.Name)
 		}
 	}
@@ -481,13 +599,22 @@ func info() error {
 	names := fun.Keys(G_TARGETS).([]string)
 	sort.Strings(names)
 
+	// Get the status checks so impaired instances stand out
+	statuses, err := instanceStatuses(G_TARGETS)
+	if err != nil {
+		errorf("Unable to retrieve instance status: %+v\n", err)
+		return err
+	}
+
 	// Print each entry
 	for _, name := range names {
 		node := G_TARGETS[name]
 		if node.Instance != nil {
-			printf("%s\t%s\t%s\n", node.Name,
+			printf("%s\t%s\t%s\t%s\t%s\n", node.Name,
 				node.Instance.PublicIpAddress,
-				node.Instance.PrivateIpAddress)
+				node.Instance.PrivateIpAddress,
+				node.StateName(),
+				healthName(statuses[node.Instance.InstanceId]))
 		}
 	}
 
@@ -528,10 +655,10 @@ func upload() error {
 		"--rsync-path=sudo rsync",
 		"-e", sshCmd,
 		G_CONFIG.Salt.RootDir+"/",
-		fmt.Sprintf("%s@%s:/srv/salt", G_CONFIG.Aws.Username, node.Instance.DNSName))
+		fmt.Sprintf("%s@%s:/srv/salt", G_CONFIG.Aws.Username, node.Address()))
 	rsync.Stdout = os.Stdout
 	rsync.Stderr = os.Stdout
-	printf("Uploading %s to %s:/srv/salt...\n", G_CONFIG.Salt.RootDir, node.Instance.PublicIpAddress)
+	printf("Uploading %s to %s:/srv/salt...\n", G_CONFIG.Salt.RootDir, node.Address())
 	err = rsync.Run()
 	if err != nil {
 		errorf("Rsync failed: %+v\n", err)
@@ -595,6 +722,15 @@ func dump() error {
 	names := fun.Keys(G_TARGETS).([]string)
 	sort.Strings(names)
 
+	// Look up the AMI each node would be launched from
+	pForEachValue(G_TARGETS, func(n *Node) error {
+		err := n.ResolveAmi()
+		if err != nil {
+			errorf("%s: unable to resolve AMI: %+v\n", n.Name, err)
+		}
+		return err
+	}, ARG_PARALLEL)
+
 	// Print each entry
 	for _, name := range names {
 		printf("%s: %+v\n", name, G_TARGETS[name])
@@ -0,0 +1,470 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/ty/fun"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Every network ACL salter manages carries this tag, set to the name of its
+// [nacls.<name>] section.
+const NACL_TAG = "SalterNacl"
+
+// The rule number of the catch all deny entry AWS adds to every ACL, which
+// can not be changed.
+const NACL_DEFAULT_RULE = 32767
+
+// A [nacls.<name>] section of the config. Subnets are either names of subnets
+// in the [vpc] network or subnet ids, in which case vpc must be the id of
+// their VPC.
+type NaclConfig struct {
+	Vpc     string   `toml:"vpc"`
+	Subnets []string `toml:"subnets"`
+	Ingress []string `toml:"ingress"`
+	Egress  []string `toml:"egress"`
+}
+
+// Creates each configured network ACL, brings its entries in line with the
+// config and associates it with its subnets.
+func nacls() error {
+	names := fun.Keys(G_CONFIG.Nacls).([]string)
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := syncNacl(name, G_CONFIG.Nacls[name])
+		if err != nil {
+			errorf("%s: %+v\n", name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses a network ACL entry. Entries are written as
+// number:action:rule, where action is allow or deny and rule uses the
+// syntax of security group rules (see parseSGRule) with a CIDR as the match.
+// The protocol may be tcp, udp, icmp, tcp/udp or all. As tcp/udp expands into
+// two entries the udp entry is given the next rule number, which must not be
+// used by another entry.
+func parseNaclRule(rule string, egress bool) ([]ec2.NetworkAclEntry, error) {
+	parts := strings.SplitN(rule, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Unknown nacl entry format: %s", rule)
+	}
+
+	number, err := strconv.Atoi(parts[0])
+	if err != nil || number < 1 || number >= NACL_DEFAULT_RULE {
+		return nil, fmt.Errorf("(%s): invalid rule number: %s", rule,
+			parts[0])
+	}
+
+	action := parts[1]
+	if action != "allow" && action != "deny" {
+		return nil, fmt.Errorf("(%s): action must be allow or deny: %s",
+			rule, action)
+	}
+
+	match := parts[2][strings.LastIndex(parts[2], ":")+1:]
+	if _, _, err := net.ParseCIDR(match); err != nil {
+		return nil, fmt.Errorf("(%s): nacl entries must match a CIDR: %s",
+			rule, match)
+	}
+
+	entry := ec2.NetworkAclEntry{
+		RuleNumber: number,
+		RuleAction: action,
+		Egress:     egress,
+		CidrBlock:  match}
+
+	if parts[2] == "all:"+match {
+		entry.Protocol = -1
+		return []ec2.NetworkAclEntry{entry}, nil
+	}
+
+	perms, err := parseSGRule(parts[2], "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]ec2.NetworkAclEntry, 0, len(perms))
+	for i, perm := range perms {
+		switch perm.Protocol {
+		case "tcp":
+			entry.Protocol = 6
+		case "udp":
+			entry.Protocol = 17
+		case "icmp":
+			// The ports of an icmp permission hold its type and code.
+			entry.Protocol = 1
+			entry.IcmpCode = ec2.IcmpCode{Type: perm.FromPort,
+				Code: perm.ToPort}
+		default:
+			return nil, fmt.Errorf("(%s): unsupported nacl protocol: %s",
+				rule, perm.Protocol)
+		}
+		entry.RuleNumber = number + i
+		entry.PortRange = ec2.PortRange{From: perm.FromPort, To: perm.ToPort}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Formats an entry using the syntax of the config.
+func naclEntryString(entry ec2.NetworkAclEntry) string {
+	switch entry.Protocol {
+	case 6, 17:
+		protocol := "tcp"
+		if entry.Protocol == 17 {
+			protocol = "udp"
+		}
+		return fmt.Sprintf("%d:%s:%s:%d:%d:%s", entry.RuleNumber,
+			entry.RuleAction, protocol, entry.PortRange.From,
+			entry.PortRange.To, entry.CidrBlock)
+	case 1:
+		return fmt.Sprintf("%d:%s:icmp:%d:%d:%s", entry.RuleNumber,
+			entry.RuleAction, entry.IcmpCode.Type, entry.IcmpCode.Code,
+			entry.CidrBlock)
+	case -1:
+		return fmt.Sprintf("%d:%s:all:%s", entry.RuleNumber,
+			entry.RuleAction, entry.CidrBlock)
+	default:
+		return fmt.Sprintf("%d:%s:%d:%s", entry.RuleNumber, entry.RuleAction,
+			entry.Protocol, entry.CidrBlock)
+	}
+}
+
+func naclEntryEqual(a, b ec2.NetworkAclEntry) bool {
+	if a.RuleNumber != b.RuleNumber || a.Egress != b.Egress ||
+		a.Protocol != b.Protocol || a.RuleAction != b.RuleAction ||
+		a.CidrBlock != b.CidrBlock {
+		return false
+	}
+	switch a.Protocol {
+	case -1:
+		return true
+	case 1:
+		return a.IcmpCode == b.IcmpCode
+	default:
+		return a.PortRange == b.PortRange
+	}
+}
+
+// Works out the VPC, region and subnet ids of a network ACL.
+func naclPlacement(name string, conf NaclConfig) (string, string, []string, error) {
+	managed := G_CONFIG.Vpc != nil &&
+		(conf.Vpc == "" || conf.Vpc == G_CONFIG.Vpc.Name)
+	if !managed {
+		if conf.Vpc == "" {
+			return "", "", nil, fmt.Errorf("a vpc is required")
+		}
+		return conf.Vpc, G_CONFIG.Aws.RegionId, conf.Subnets, nil
+	}
+
+	network, err := findNetwork(G_CONFIG.Vpc)
+	if err != nil {
+		return "", "", nil, err
+	} else if network.Vpc == nil {
+		return "", "", nil, fmt.Errorf("network %s has not been created",
+			G_CONFIG.Vpc.Name)
+	}
+
+	subnetIds := make([]string, 0, len(conf.Subnets))
+	for _, subnet := range conf.Subnets {
+		if live, found := network.Subnets[subnet]; found {
+			subnetIds = append(subnetIds, live.SubnetId)
+		} else if strings.HasPrefix(subnet, "subnet-") {
+			subnetIds = append(subnetIds, subnet)
+		} else {
+			return "", "", nil, fmt.Errorf("unknown subnet %s", subnet)
+		}
+	}
+	return network.Vpc.VpcId, G_CONFIG.Vpc.RegionId, subnetIds, nil
+}
+
+func syncNacl(name string, conf NaclConfig) error {
+	// Each rule number can only be used once in each direction, including
+	// the numbers that tcp/udp entries take for their udp half.
+	desired := make([]ec2.NetworkAclEntry, 0)
+	numbers := make(map[string]string)
+	for _, rules := range []struct {
+		list   []string
+		egress bool
+	}{{conf.Ingress, false}, {conf.Egress, true}} {
+		for _, rule := range rules.list {
+			entries, err := parseNaclRule(rule, rules.egress)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				key := fmt.Sprintf("%d/%t", entry.RuleNumber, entry.Egress)
+				if other, found := numbers[key]; found {
+					return fmt.Errorf("(%s): rule number %d is already "+
+						"used by %s", rule, entry.RuleNumber, other)
+				}
+				numbers[key] = rule
+			}
+			desired = append(desired, entries...)
+		}
+	}
+
+	vpcId, regionId, subnetIds, err := naclPlacement(name, conf)
+	if err != nil {
+		return err
+	}
+	conn := ec2.New(G_CONFIG.AwsAuth, aws.Regions[regionId])
+
+	// Find the ACL, creating it the first time through.
+	filter := ec2.NewFilter()
+	filter.Add("vpc-id", vpcId)
+	filter.Add("tag:"+NACL_TAG, name)
+	addClusterFilter(filter)
+	resp, err := conn.NetworkAcls(nil, filter)
+	if err != nil {
+		return err
+	}
+
+	var acl *ec2.NetworkAcl
+	if len(resp.NetworkAcls) > 0 {
+		acl = &resp.NetworkAcls[0]
+	} else {
+		createResp, err := conn.CreateNetworkAcl(&ec2.CreateNetworkAcl{
+			VpcId: vpcId})
+		if err != nil {
+			return fmt.Errorf("unable to create network acl: %+v", err)
+		}
+		acl = &createResp.NetworkAcl
+		_, err = conn.CreateTags([]string{acl.NetworkAclId}, withClusterTag(
+			ec2.Tag{Key: "Name", Value: name},
+			ec2.Tag{Key: NACL_TAG, Value: name}))
+		if err != nil {
+			return fmt.Errorf("unable to tag %s: %+v", acl.NetworkAclId, err)
+		}
+		printf("%s: created network acl %s\n", name, acl.NetworkAclId)
+	}
+
+	// Compare the entries against the live ones. A live entry that differs
+	// from the config under the same number has to be deleted before the
+	// configured one can be created.
+	missing := make([]ec2.NetworkAclEntry, 0)
+	extra := make([]ec2.NetworkAclEntry, 0)
+	taken := make(map[string]bool)
+	for _, live := range acl.EntrySet {
+		if live.RuleNumber == NACL_DEFAULT_RULE {
+			continue
+		}
+
+		found := false
+		for _, entry := range desired {
+			if naclEntryEqual(entry, live) {
+				found = true
+			}
+		}
+		if !found {
+			extra = append(extra, live)
+		}
+		taken[fmt.Sprintf("%d/%t", live.RuleNumber, live.Egress)] = !found
+	}
+	for _, entry := range desired {
+		found := false
+		for _, live := range acl.EntrySet {
+			if naclEntryEqual(entry, live) {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, entry)
+		}
+	}
+
+	if len(missing) > 0 || len(extra) > 0 {
+		printf("%s (%s):\n", name, acl.NetworkAclId)
+		for _, entry := range missing {
+			printf("  + %s %s\n", naclDirection(entry), naclEntryString(entry))
+		}
+		for _, entry := range extra {
+			printf("  - %s %s\n", naclDirection(entry), naclEntryString(entry))
+		}
+	}
+
+	if len(extra) > 0 && !ARG_RECONCILE {
+		printf("%s has drifted from the config by %d entries; use "+
+			"-reconcile to remove them\n", name, len(extra))
+	} else if len(extra) > 0 && confirm(fmt.Sprintf(
+		"Delete %d entries from %s?", len(extra), name)) {
+		for _, entry := range extra {
+			_, err = conn.DeleteNetworkAclEntry(acl.NetworkAclId,
+				entry.RuleNumber, entry.Egress)
+			if err != nil {
+				return fmt.Errorf("unable to delete entry %d: %+v",
+					entry.RuleNumber, err)
+			}
+			taken[fmt.Sprintf("%d/%t", entry.RuleNumber, entry.Egress)] = false
+		}
+		printf("Deleted %d entries from %s\n", len(extra), name)
+	}
+
+	for _, entry := range missing {
+		if taken[fmt.Sprintf("%d/%t", entry.RuleNumber, entry.Egress)] {
+			printf("%s: not adding %s; rule %d is in use\n", name,
+				naclEntryString(entry), entry.RuleNumber)
+			continue
+		}
+
+		entry := entry
+		if entry.Protocol == 1 {
+			err = createIcmpNaclEntry(conn, acl.NetworkAclId, &entry)
+		} else {
+			_, err = conn.CreateNetworkAclEntry(acl.NetworkAclId, &entry)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to create entry %d: %+v",
+				entry.RuleNumber, err)
+		}
+		printf("%s: added %s %s\n", name, naclDirection(entry),
+			naclEntryString(entry))
+	}
+
+	return associateNacl(conn, name, acl.NetworkAclId, subnetIds)
+}
+
+// Creates an icmp entry in a network ACL. The vendored ec2 library only sends
+// the icmp type and code along with protocol -1 rather than icmp's 1, so the
+// request is signed and sent here instead, the same way the library does.
+func createIcmpNaclEntry(conn *ec2.EC2, aclId string, entry *ec2.NetworkAclEntry) error {
+	params := map[string]string{
+		"Action":           "CreateNetworkAclEntry",
+		"Version":          "2014-06-15",
+		"Timestamp":        time.Now().UTC().Format(time.RFC3339),
+		"NetworkAclId":     aclId,
+		"RuleNumber":       strconv.Itoa(entry.RuleNumber),
+		"Protocol":         "1",
+		"RuleAction":       entry.RuleAction,
+		"Egress":           strconv.FormatBool(entry.Egress),
+		"CidrBlock":        entry.CidrBlock,
+		"Icmp.Type":        strconv.Itoa(entry.IcmpCode.Type),
+		"Icmp.Code":        strconv.Itoa(entry.IcmpCode.Code),
+		"AWSAccessKeyId":   conn.Auth.AccessKey,
+		"SignatureVersion": "2",
+		"SignatureMethod":  "HmacSHA256"}
+	if conn.Auth.Token != "" {
+		params["SecurityToken"] = conn.Auth.Token
+	}
+
+	endpoint, err := url.Parse(conn.Region.EC2Endpoint)
+	if err != nil {
+		return err
+	} else if endpoint.Path == "" {
+		endpoint.Path = "/"
+	}
+
+	// Parameters are signed in the order of their names.
+	keys := fun.Keys(params).([]string)
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = aws.Encode(key) + "=" + aws.Encode(params[key])
+	}
+	query := strings.Join(pairs, "&")
+
+	hash := hmac.New(sha256.New, []byte(conn.Auth.SecretKey))
+	hash.Write([]byte("GET\n" + endpoint.Host + "\n" + endpoint.Path + "\n" +
+		query))
+	endpoint.RawQuery = query + "&Signature=" +
+		aws.Encode(base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+
+	resp, err := aws.RetryingClient.Get(endpoint.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var errors struct {
+			Errors []ec2.Error `xml:"Errors>Error"`
+		}
+		xml.NewDecoder(resp.Body).Decode(&errors)
+		if len(errors.Errors) == 0 {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		ec2Err := errors.Errors[0]
+		ec2Err.StatusCode = resp.StatusCode
+		return &ec2Err
+	}
+	return nil
+}
+
+func naclDirection(entry ec2.NetworkAclEntry) string {
+	if entry.Egress {
+		return "egress"
+	}
+	return "ingress"
+}
+
+// Moves each subnet over to the network ACL. Every subnet is always
+// associated with exactly one ACL, so this replaces its current association.
+func associateNacl(conn *ec2.EC2, name, aclId string, subnetIds []string) error {
+	if len(subnetIds) == 0 {
+		return nil
+	}
+
+	filter := ec2.NewFilter()
+	filter.Add("association.subnet-id", subnetIds...)
+	resp, err := conn.NetworkAcls(nil, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, subnetId := range subnetIds {
+		for _, acl := range resp.NetworkAcls {
+			for _, assoc := range acl.AssociationSet {
+				if assoc.SubnetId != subnetId || acl.NetworkAclId == aclId {
+					continue
+				}
+
+				_, err = conn.ReplaceNetworkAclAssociation(
+					assoc.NetworkAclAssociationId, aclId)
+				if err != nil {
+					return fmt.Errorf("unable to associate %s: %+v", subnetId,
+						err)
+				}
+				printf("%s: associated with %s (was %s)\n", name, subnetId,
+					acl.NetworkAclId)
+			}
+		}
+	}
+	return nil
+}
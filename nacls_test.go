@@ -0,0 +1,72 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNaclRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected []string
+	}{
+		{"100:allow:all:10.0.0.0/16", []string{"100:allow:all:10.0.0.0/16"}},
+		{"110:deny:tcp:22:0.0.0.0/0", []string{"110:deny:tcp:22:22:0.0.0.0/0"}},
+		{"120:allow:tcp/udp:1024:65535:0.0.0.0/0",
+			[]string{"120:allow:tcp:1024:65535:0.0.0.0/0",
+				"121:allow:udp:1024:65535:0.0.0.0/0"}},
+		{"130:allow:icmp:ping:0.0.0.0/0",
+			[]string{"130:allow:icmp:8:-1:0.0.0.0/0"}},
+	}
+
+	for _, test := range tests {
+		entries, err := parseNaclRule(test.rule, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.rule, err)
+			continue
+		}
+
+		rules := make([]string, len(entries))
+		for i, entry := range entries {
+			rules[i] = naclEntryString(entry)
+			if !naclEntryEqual(entry, entry) {
+				t.Errorf("%s: entry %d is not equal to itself", test.rule, i)
+			}
+		}
+		if !reflect.DeepEqual(rules, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.rule, test.expected,
+				rules)
+		}
+	}
+
+	for _, rule := range []string{"0:allow:all:0.0.0.0/0",
+		"32767:allow:all:0.0.0.0/0", "x:allow:all:0.0.0.0/0",
+		"100:permit:all:0.0.0.0/0", "100:allow:tcp:22:default",
+		"100:allow:tcp"} {
+		if _, err := parseNaclRule(rule, false); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
@@ -0,0 +1,691 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Every resource salter creates for a network carries this tag, set to the
+// name of the network, so that it can be found again.
+const NETWORK_TAG = "SalterNetwork"
+
+// The VPC records the id of the DHCP options salter created for it, as DHCP
+// options can not be looked up by tag.
+const NETWORK_DHCP_TAG = "DhcpOptions"
+
+// The [vpc] section of the config, describing a network owned by salter.
+type VpcConfig struct {
+	Name            string         `toml:"name"`
+	Cidr            string         `toml:"cidr"`
+	RegionId        string         `toml:"region"`
+	InternetGateway bool           `toml:"internet_gateway"`
+	DnsHostnames    bool           `toml:"dns_hostnames"`
+	Subnets         []SubnetConfig `toml:"subnets"`
+	Dhcp            *DhcpConfig    `toml:"dhcp"`
+}
+
+// A subnet of the network. Public subnets route to the internet gateway and
+// give instances a public IP by default.
+type SubnetConfig struct {
+	Name   string `toml:"name"`
+	Zone   string `toml:"zone"`
+	Cidr   string `toml:"cidr"`
+	Public bool   `toml:"public"`
+}
+
+type DhcpConfig struct {
+	DomainName        string   `toml:"domain_name"`
+	DomainNameServers []string `toml:"domain_name_servers"`
+	NtpServers        []string `toml:"ntp_servers"`
+}
+
+// The live state of a network. Resources that don't exist yet are nil.
+type Network struct {
+	Config     *VpcConfig
+	Conn       *ec2.EC2
+	Vpc        *ec2.VPC
+	Gateway    *ec2.InternetGateway
+	RouteTable *ec2.RouteTable
+	Subnets    map[string]*ec2.Subnet
+}
+
+func (v *VpcConfig) validate() error {
+	if v.Name == "" {
+		return fmt.Errorf("vpc: a name is required")
+	} else if v.Cidr == "" {
+		return fmt.Errorf("vpc: a cidr is required")
+	}
+
+	seen := make(map[string]bool)
+	for _, subnet := range v.Subnets {
+		switch {
+		case subnet.Name == "":
+			return fmt.Errorf("vpc: subnets require a name")
+		case seen[subnet.Name]:
+			return fmt.Errorf("vpc: subnet %s is defined twice", subnet.Name)
+		case subnet.Zone == "" || subnet.Cidr == "":
+			return fmt.Errorf("vpc: subnet %s requires a zone and cidr",
+				subnet.Name)
+		}
+		seen[subnet.Name] = true
+	}
+	return nil
+}
+
+// Returns the configured subnet with the given name, or nil.
+func (v *VpcConfig) subnet(name string) *SubnetConfig {
+	for i := range v.Subnets {
+		if v.Subnets[i].Name == name {
+			return &v.Subnets[i]
+		}
+	}
+	return nil
+}
+
+// Returns true if any of the subnets route to the internet gateway.
+func (v *VpcConfig) needsGateway() bool {
+	if v.InternetGateway {
+		return true
+	}
+	for _, subnet := range v.Subnets {
+		if subnet.Public {
+			return true
+		}
+	}
+	return false
+}
+
+// Manages the network described in the [vpc] section of the config. The
+// argument is the action; create, show (the default) or teardown.
+func network() error {
+	if G_CONFIG.Vpc == nil {
+		errorf("No [vpc] section in the config.\n")
+		return fmt.Errorf("no network configured")
+	}
+
+	action := "show"
+	if len(G_ARGS) == 1 {
+		action = G_ARGS[0]
+	} else if len(G_ARGS) > 1 {
+		errorf("usage: salter network [create|show|teardown]\n")
+		return fmt.Errorf("too many arguments")
+	}
+
+	net, err := findNetwork(G_CONFIG.Vpc)
+	if err != nil {
+		errorf("Unable to retrieve network %s: %+v\n", G_CONFIG.Vpc.Name, err)
+		return err
+	}
+
+	switch action {
+	case "create":
+		err = net.Create()
+	case "show":
+		net.Show()
+	case "teardown":
+		if !confirm(fmt.Sprintf("Tear down network %s?", net.Config.Name)) {
+			return nil
+		}
+		err = net.Teardown()
+	default:
+		errorf("usage: salter network [create|show|teardown]\n")
+		return fmt.Errorf("unknown network action %s", action)
+	}
+
+	if err != nil {
+		errorf("%s: %+v\n", net.Config.Name, err)
+	}
+	return err
+}
+
+// Looks up the live state of the network from the resources tagged with its
+// name.
+func findNetwork(config *VpcConfig) (*Network, error) {
+	net := &Network{
+		Config:  config,
+		Conn:    ec2.New(G_CONFIG.AwsAuth, aws.Regions[config.RegionId]),
+		Subnets: make(map[string]*ec2.Subnet),
+	}
+
+	filter := ec2.NewFilter()
+	filter.Add("tag:"+NETWORK_TAG, config.Name)
+	addClusterFilter(filter)
+
+	vpcResp, err := net.Conn.DescribeVpcs(nil, filter)
+	if err != nil {
+		return nil, err
+	} else if len(vpcResp.VPCs) > 1 {
+		return nil, fmt.Errorf("more than one VPC tagged %s", config.Name)
+	} else if len(vpcResp.VPCs) == 0 {
+		return net, nil
+	}
+	net.Vpc = &vpcResp.VPCs[0]
+
+	gwResp, err := net.Conn.DescribeInternetGateways(nil, filter)
+	if err != nil {
+		return nil, err
+	} else if len(gwResp.InternetGateways) > 0 {
+		net.Gateway = &gwResp.InternetGateways[0]
+	}
+
+	rtResp, err := net.Conn.DescribeRouteTables(nil, filter)
+	if err != nil {
+		return nil, err
+	} else if len(rtResp.RouteTables) > 0 {
+		net.RouteTable = &rtResp.RouteTables[0]
+	}
+
+	subnetResp, err := net.Conn.DescribeSubnets(nil, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subnetResp.Subnets {
+		subnet := &subnetResp.Subnets[i]
+		name, _ := findTag(subnet.Tags, "Name")
+		net.Subnets[strings.TrimPrefix(name, config.Name+"-")] = subnet
+	}
+
+	return net, nil
+}
+
+// Tags a network resource with its name and the network it belongs to.
+func (net *Network) tag(id, name string) error {
+	_, err := net.Conn.CreateTags([]string{id}, withClusterTag(
+		ec2.Tag{Key: "Name", Value: name},
+		ec2.Tag{Key: NETWORK_TAG, Value: net.Config.Name}))
+	if err != nil {
+		return fmt.Errorf("unable to tag %s: %+v", id, err)
+	}
+	return nil
+}
+
+// Creates any part of the network that does not exist yet. Existing
+// resources are left as they are, so this is safe to run repeatedly.
+func (net *Network) Create() error {
+	config := net.Config
+
+	if net.Vpc == nil {
+		resp, err := net.Conn.CreateVpc(&ec2.CreateVpc{CidrBlock: config.Cidr})
+		if err != nil {
+			return fmt.Errorf("unable to create VPC: %+v", err)
+		}
+		net.Vpc = &resp.VPC
+		if err = net.tag(net.Vpc.VpcId, config.Name); err != nil {
+			return err
+		}
+		printf("%s: created VPC %s (%s)\n", config.Name, net.Vpc.VpcId,
+			config.Cidr)
+
+		if config.DnsHostnames {
+			_, err = net.Conn.ModifyVpcAttribute(net.Vpc.VpcId,
+				&ec2.ModifyVpcAttribute{
+					EnableDnsHostnames:    true,
+					SetEnableDnsHostnames: true})
+			if err != nil {
+				return fmt.Errorf("unable to enable DNS hostnames: %+v", err)
+			}
+		}
+	}
+
+	if err := net.createDhcpOptions(); err != nil {
+		return err
+	}
+
+	if config.needsGateway() {
+		if err := net.createGateway(); err != nil {
+			return err
+		}
+	}
+
+	for i := range config.Subnets {
+		if err := net.createSubnet(&config.Subnets[i]); err != nil {
+			return err
+		}
+	}
+
+	if net.Gateway != nil {
+		if err := net.createRouteTable(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (net *Network) createDhcpOptions() error {
+	dhcp := net.Config.Dhcp
+	if dhcp == nil {
+		return nil
+	}
+
+	// Reuse the options created by an earlier run, putting them back if
+	// something else has been associated with the VPC since. A new set is
+	// only created if there are none yet, or the old set has gone away.
+	current, _ := findTag(net.Vpc.Tags, NETWORK_DHCP_TAG)
+	if current != "" && current == net.Vpc.DHCPOptionsID {
+		return nil
+	} else if current != "" {
+		_, err := net.Conn.AssociateDhcpOptions(current, net.Vpc.VpcId)
+		if err == nil {
+			net.Vpc.DHCPOptionsID = current
+			printf("%s: associated DHCP options %s\n", net.Config.Name,
+				current)
+			return nil
+		}
+		debugf("%s: unable to reuse DHCP options %s: %+v\n",
+			net.Config.Name, current, err)
+	}
+
+	resp, err := net.Conn.CreateDhcpOptions(&ec2.CreateDhcpOptions{
+		DomainName:        dhcp.DomainName,
+		DomainNameServers: strings.Join(dhcp.DomainNameServers, ","),
+		NtpServers:        strings.Join(dhcp.NtpServers, ",")})
+	if err != nil {
+		return fmt.Errorf("unable to create DHCP options: %+v", err)
+	}
+	id := resp.DhcpOptions.DhcpOptionsId
+	if err = net.tag(id, net.Config.Name); err != nil {
+		return err
+	}
+
+	_, err = net.Conn.AssociateDhcpOptions(id, net.Vpc.VpcId)
+	if err != nil {
+		return fmt.Errorf("unable to associate DHCP options: %+v", err)
+	}
+
+	_, err = net.Conn.CreateTags([]string{net.Vpc.VpcId},
+		withClusterTag(ec2.Tag{Key: NETWORK_DHCP_TAG, Value: id}))
+	if err != nil {
+		return fmt.Errorf("unable to tag %s: %+v", net.Vpc.VpcId, err)
+	}
+	net.Vpc.DHCPOptionsID = id
+	printf("%s: created DHCP options %s\n", net.Config.Name, id)
+	return nil
+}
+
+func (net *Network) createGateway() error {
+	if net.Gateway == nil {
+		resp, err := net.Conn.CreateInternetGateway(
+			&ec2.CreateInternetGateway{})
+		if err != nil {
+			return fmt.Errorf("unable to create internet gateway: %+v", err)
+		}
+		net.Gateway = &resp.InternetGateway
+		if err = net.tag(net.Gateway.InternetGatewayId,
+			net.Config.Name); err != nil {
+			return err
+		}
+		printf("%s: created internet gateway %s\n", net.Config.Name,
+			net.Gateway.InternetGatewayId)
+	}
+
+	for _, attachment := range net.Gateway.Attachments {
+		if attachment.VpcId == net.Vpc.VpcId {
+			return nil
+		}
+	}
+
+	_, err := net.Conn.AttachInternetGateway(net.Gateway.InternetGatewayId,
+		net.Vpc.VpcId)
+	if err != nil {
+		return fmt.Errorf("unable to attach internet gateway: %+v", err)
+	}
+	net.Gateway.Attachments = append(net.Gateway.Attachments,
+		ec2.InternetGatewayAttachment{VpcId: net.Vpc.VpcId})
+	return nil
+}
+
+func (net *Network) createSubnet(config *SubnetConfig) error {
+	if _, found := net.Subnets[config.Name]; found {
+		return nil
+	}
+
+	resp, err := net.Conn.CreateSubnet(&ec2.CreateSubnet{
+		VpcId:            net.Vpc.VpcId,
+		CidrBlock:        config.Cidr,
+		AvailabilityZone: config.Zone})
+	if err != nil {
+		return fmt.Errorf("unable to create subnet %s: %+v", config.Name, err)
+	}
+	subnet := &resp.Subnet
+	if err = net.tag(subnet.SubnetId,
+		net.Config.Name+"-"+config.Name); err != nil {
+		return err
+	}
+
+	if config.Public {
+		_, err = net.Conn.ModifySubnetAttribute(&ec2.ModifySubnetAttribute{
+			SubnetId:            subnet.SubnetId,
+			MapPublicIpOnLaunch: true})
+		if err != nil {
+			return fmt.Errorf("unable to modify subnet %s: %+v",
+				config.Name, err)
+		}
+	}
+
+	net.Subnets[config.Name] = subnet
+	printf("%s: created subnet %s %s (%s in %s)\n", net.Config.Name,
+		config.Name, subnet.SubnetId, config.Cidr, config.Zone)
+	return nil
+}
+
+// Creates the route table for the public subnets, which sends everything
+// outside of the VPC through the internet gateway. Private subnets are left
+// on the VPC's main route table.
+func (net *Network) createRouteTable() error {
+	if net.RouteTable == nil {
+		resp, err := net.Conn.CreateRouteTable(&ec2.CreateRouteTable{
+			VpcId: net.Vpc.VpcId})
+		if err != nil {
+			return fmt.Errorf("unable to create route table: %+v", err)
+		}
+		net.RouteTable = &resp.RouteTable
+		if err = net.tag(net.RouteTable.RouteTableId,
+			net.Config.Name+"-public"); err != nil {
+			return err
+		}
+		printf("%s: created route table %s\n", net.Config.Name,
+			net.RouteTable.RouteTableId)
+	}
+
+	hasDefault := false
+	for _, route := range net.RouteTable.Routes {
+		if route.DestinationCidrBlock == "0.0.0.0/0" {
+			hasDefault = true
+		}
+	}
+	if !hasDefault {
+		_, err := net.Conn.CreateRoute(&ec2.CreateRoute{
+			RouteTableId:         net.RouteTable.RouteTableId,
+			DestinationCidrBlock: "0.0.0.0/0",
+			GatewayId:            net.Gateway.InternetGatewayId})
+		if err != nil {
+			return fmt.Errorf("unable to create default route: %+v", err)
+		}
+	}
+
+	associated := make(map[string]bool)
+	for _, assoc := range net.RouteTable.Associations {
+		associated[assoc.SubnetId] = true
+	}
+	for _, config := range net.Config.Subnets {
+		subnet := net.Subnets[config.Name]
+		if !config.Public || associated[subnet.SubnetId] {
+			continue
+		}
+
+		_, err := net.Conn.AssociateRouteTable(net.RouteTable.RouteTableId,
+			subnet.SubnetId)
+		if err != nil {
+			return fmt.Errorf("unable to associate route table with %s: %+v",
+				config.Name, err)
+		}
+	}
+	return nil
+}
+
+// Displays each part of the network and its id, or that it is missing.
+func (net *Network) Show() {
+	config := net.Config
+	id := func(exists bool, id string) string {
+		if !exists {
+			return "missing"
+		}
+		return id
+	}
+
+	if net.Vpc == nil {
+		printf("%s\tvpc\t%s\tmissing\n", config.Name, config.Cidr)
+		return
+	}
+	printf("%s\tvpc\t%s\t%s\n", config.Name, net.Vpc.CidrBlock,
+		net.Vpc.VpcId)
+
+	if config.Dhcp != nil {
+		current, _ := findTag(net.Vpc.Tags, NETWORK_DHCP_TAG)
+		printf("%s\tdhcp\t\t%s\n", config.Name,
+			id(current != "" && current == net.Vpc.DHCPOptionsID, current))
+	}
+
+	if config.needsGateway() {
+		gatewayId := ""
+		if net.Gateway != nil {
+			gatewayId = net.Gateway.InternetGatewayId
+		}
+		printf("%s\tgateway\t\t%s\n", config.Name,
+			id(net.Gateway != nil, gatewayId))
+	}
+
+	for _, subnetConfig := range config.Subnets {
+		subnet, found := net.Subnets[subnetConfig.Name]
+		subnetId := ""
+		if found {
+			subnetId = subnet.SubnetId
+		}
+		printf("%s\tsubnet %s\t%s %s\t%s\n", config.Name, subnetConfig.Name,
+			subnetConfig.Cidr, subnetConfig.Zone, id(found, subnetId))
+	}
+}
+
+// Deletes every part of the network, in the reverse order of creation.
+// This fails if there are still instances in any of the subnets.
+func (net *Network) Teardown() error {
+	if net.Vpc == nil {
+		printf("%s: network does not exist\n", net.Config.Name)
+		return nil
+	}
+
+	if net.RouteTable != nil {
+		for _, assoc := range net.RouteTable.Associations {
+			if assoc.Main {
+				continue
+			}
+			_, err := net.Conn.DisassociateRouteTable(assoc.AssociationId)
+			if err != nil {
+				return fmt.Errorf("unable to disassociate route table: %+v",
+					err)
+			}
+		}
+		_, err := net.Conn.DeleteRouteTable(net.RouteTable.RouteTableId)
+		if err != nil {
+			return fmt.Errorf("unable to delete route table: %+v", err)
+		}
+		printf("%s: deleted route table %s\n", net.Config.Name,
+			net.RouteTable.RouteTableId)
+	}
+
+	for name, subnet := range net.Subnets {
+		_, err := net.Conn.DeleteSubnet(subnet.SubnetId)
+		if err != nil {
+			return fmt.Errorf("unable to delete subnet %s: %+v", name, err)
+		}
+		printf("%s: deleted subnet %s %s\n", net.Config.Name, name,
+			subnet.SubnetId)
+	}
+
+	if net.Gateway != nil {
+		id := net.Gateway.InternetGatewayId
+		for _, attachment := range net.Gateway.Attachments {
+			_, err := net.Conn.DetachInternetGateway(id, attachment.VpcId)
+			if err != nil {
+				return fmt.Errorf("unable to detach internet gateway: %+v",
+					err)
+			}
+		}
+		_, err := net.Conn.DeleteInternetGateway(id)
+		if err != nil {
+			return fmt.Errorf("unable to delete internet gateway: %+v", err)
+		}
+		printf("%s: deleted internet gateway %s\n", net.Config.Name, id)
+	}
+
+	// The sgroups and nacls commands create groups and ACLs in the VPC,
+	// which have to go before the VPC can.
+	if err := net.deleteNetworkAcls(); err != nil {
+		return err
+	}
+	if err := net.deleteSecurityGroups(); err != nil {
+		return err
+	}
+
+	_, err := net.Conn.DeleteVpc(net.Vpc.VpcId)
+	if err != nil {
+		return fmt.Errorf("unable to delete VPC: %+v", err)
+	}
+	printf("%s: deleted VPC %s\n", net.Config.Name, net.Vpc.VpcId)
+
+	// DHCP options can only be deleted once nothing is associated with them.
+	if dhcpId, _ := findTag(net.Vpc.Tags, NETWORK_DHCP_TAG); dhcpId != "" {
+		_, err = net.Conn.DeleteDhcpOptions(dhcpId)
+		if err != nil {
+			return fmt.Errorf("unable to delete DHCP options: %+v", err)
+		}
+		printf("%s: deleted DHCP options %s\n", net.Config.Name, dhcpId)
+	}
+
+	return nil
+}
+
+// Deletes the network ACLs of this cluster in the VPC. The default ACL goes
+// with the VPC.
+func (net *Network) deleteNetworkAcls() error {
+	filter := ec2.NewFilter()
+	filter.Add("vpc-id", net.Vpc.VpcId)
+	addClusterFilter(filter)
+	resp, err := net.Conn.NetworkAcls(nil, filter)
+	if err != nil {
+		return fmt.Errorf("unable to list network acls: %+v", err)
+	}
+
+	for _, acl := range resp.NetworkAcls {
+		if acl.Default == "true" {
+			continue
+		}
+		_, err = net.Conn.DeleteNetworkAcl(acl.NetworkAclId)
+		if err != nil {
+			return fmt.Errorf("unable to delete network acl %s: %+v",
+				acl.NetworkAclId, err)
+		}
+		printf("%s: deleted network acl %s\n", net.Config.Name,
+			acl.NetworkAclId)
+	}
+	return nil
+}
+
+// Deletes the security groups of this cluster in the VPC. Groups can refer
+// to each other in their rules, which keeps them from being deleted, so all
+// of the rules are revoked first.
+func (net *Network) deleteSecurityGroups() error {
+	filter := ec2.NewFilter()
+	filter.Add("vpc-id", net.Vpc.VpcId)
+	addClusterFilter(filter)
+	resp, err := net.Conn.SecurityGroups(nil, filter)
+	if err != nil {
+		return fmt.Errorf("unable to list security groups: %+v", err)
+	}
+
+	groups := make([]ec2.SecurityGroupInfo, 0, len(resp.Groups))
+	for _, group := range resp.Groups {
+		if group.Name != "default" {
+			groups = append(groups, group)
+		}
+	}
+
+	for _, group := range groups {
+		if len(group.IPPerms) > 0 {
+			_, err = net.Conn.RevokeSecurityGroup(group.SecurityGroup,
+				group.IPPerms)
+			if err != nil {
+				return fmt.Errorf("unable to revoke rules of %s: %+v",
+					group.Name, err)
+			}
+		}
+		if len(group.IPPermsEgress) > 0 {
+			_, err = net.Conn.RevokeSecurityGroupEgress(group.SecurityGroup,
+				group.IPPermsEgress)
+			if err != nil {
+				return fmt.Errorf("unable to revoke rules of %s: %+v",
+					group.Name, err)
+			}
+		}
+	}
+
+	for _, group := range groups {
+		_, err = net.Conn.DeleteSecurityGroup(
+			ec2.SecurityGroup{Id: group.Id})
+		if err != nil {
+			return fmt.Errorf("unable to delete security group %s: %+v",
+				group.Name, err)
+		}
+		printf("%s: deleted security group %s (%s)\n", net.Config.Name,
+			group.Name, group.Id)
+	}
+	return nil
+}
+
+// Replaces the names of the managed VPC and subnets in the node config with
+// their ids. Nodes refer to the network by name as the ids are not known
+// until it has been created.
+func (config *Config) resolveNetwork() error {
+	if config.Vpc == nil {
+		return nil
+	}
+
+	used := false
+	for _, node := range config.Nodes {
+		if node.Vpc == config.Vpc.Name {
+			used = true
+		}
+	}
+	if !used {
+		return nil
+	}
+
+	net, err := findNetwork(config.Vpc)
+	if err != nil {
+		return err
+	} else if net.Vpc == nil {
+		return fmt.Errorf("network %s has not been created; run 'salter "+
+			"network create'", config.Vpc.Name)
+	}
+
+	for _, node := range config.Nodes {
+		if node.Vpc != config.Vpc.Name {
+			continue
+		}
+		node.Vpc = net.Vpc.VpcId
+
+		if subnet, found := net.Subnets[node.Subnet]; found {
+			node.Subnet = subnet.SubnetId
+		} else if config.Vpc.subnet(node.Subnet) != nil {
+			return fmt.Errorf("subnet %s of network %s has not been created",
+				node.Subnet, config.Vpc.Name)
+		}
+	}
+	return nil
+}
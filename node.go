@@ -50,33 +50,69 @@ type Node struct {
 	// Tags attached to these nodes.
 	Tags TagMap `toml:"tags"`
 
+	// EBS volumes attached to these nodes.
+	Volumes []VolumeConfig `toml:"volumes"`
+
+	// The elastic IP to associate with the node, if any.
+	Eip ElasticIp `toml:"eip"`
+
 	// Allow all the same values found in the AwsConfig value.
 	AwsConfig
 
+	// The AMI id that Ami (or Image) resolved to in the node's region.
+	AmiId string `toml:"-"`
+
+	// Device -> snapshot id to create volumes from when restoring.
+	restoreSnapshots map[string]string
+
 	Instance  *ec2.Instance `toml:"-"`
 	SshClient *ssh.Client   `toml:"-"`
 }
 
+// Instance state codes as reported by EC2. Only the low byte of the code is
+// meaningful.
+const (
+	STATE_PENDING       = 0
+	STATE_RUNNING       = 16
+	STATE_SHUTTING_DOWN = 32
+	STATE_TERMINATED    = 48
+	STATE_STOPPING      = 64
+	STATE_STOPPED       = 80
+)
+
 func (node *Node) Conn() *ec2.EC2 {
 	return ec2.New(G_CONFIG.AwsAuth, aws.Regions[node.RegionId])
 }
 
 // Retrieve instance information from AWS
 func (node *Node) Update() error {
+	err := node.updateClaimed()
+	if err != nil {
+		return err
+	} else if node.Instance == nil {
+		// Nothing was returned in the list; it's not running. Unless there
+		// is an instance launched before clusters were tagged, which would
+		// otherwise be duplicated by the next launch.
+		return node.checkUnclaimed()
+	}
+	return nil
+}
+
+// Retrieves the node's instance within this cluster, leaving it nil when
+// there is none. Unlike Update, instances without a cluster tag are ignored.
+func (node *Node) updateClaimed() error {
 	// Clear out current instance info
 	node.Instance = nil
 
-	// Use the node name as our primary filter
-	filter := ec2.NewFilter()
-	filter.Add("tag:Name", node.Name)
-	filter.Add("instance-state-code", "0", "16")
+	// Use the node name as our primary filter, within this cluster
+	filter := node.instanceFilter()
+	addClusterFilter(filter)
 	response, err := node.Conn().Instances(nil, filter)
 	if err != nil {
 		return err
 	}
 
 	if len(response.Reservations) == 0 {
-		// Nothing was returned in the list; it's not running
 		return nil
 	}
 
@@ -91,13 +127,61 @@ func (node *Node) Update() error {
 	return nil
 }
 
-func (node *Node) IsRunning() bool {
-	// Determine if the node is live on AWS and running or pending
+// Returns a filter matching the live instances named after the node, in any
+// cluster.
+func (node *Node) instanceFilter() *ec2.Filter {
+	filter := ec2.NewFilter()
+	filter.Add("tag:Name", node.Name)
+	filter.Add("instance-state-code",
+		fmt.Sprint(STATE_PENDING), fmt.Sprint(STATE_RUNNING),
+		fmt.Sprint(STATE_STOPPING), fmt.Sprint(STATE_STOPPED))
+	return filter
+}
+
+// Looks for an instance of the node without a cluster tag.
+func (node *Node) checkUnclaimed() error {
+	response, err := node.Conn().Instances(nil, node.instanceFilter())
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range response.Reservations {
+		for _, instance := range reservation.Instances {
+			if _, found := findTag(instance.Tags, CLUSTER_TAG); !found {
+				return checkCluster(instance.InstanceId, instance.Tags)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the state code of the node's instance, or -1 if the node has no
+// instance on AWS.
+func (node *Node) State() int {
+	if node.Instance == nil {
+		return -1
+	}
+	return node.Instance.State.Code & 0xff
+}
+
+// Returns a human readable version of the node's state.
+func (node *Node) StateName() string {
 	if node.Instance == nil {
-		return false
-	} else {
-		return node.Instance.State.Code < 32
+		return "absent"
 	}
+	return node.Instance.State.Name
+}
+
+func (node *Node) IsRunning() bool {
+	// Determine if the node is live on AWS and running or pending
+	state := node.State()
+	return state == STATE_PENDING || state == STATE_RUNNING
+}
+
+func (node *Node) IsStopped() bool {
+	// Determine if the node is live on AWS but stopped or stopping
+	state := node.State()
+	return state == STATE_STOPPING || state == STATE_STOPPED
 }
 
 // Start the node on AWS
@@ -107,15 +191,29 @@ func (node *Node) Start(masterIp string) error {
 		return nil
 	}
 
+	// If the node was stopped then bring the existing instance back rather
+	// than launching a duplicate.
+	if node.State() == STATE_STOPPED {
+		return node.PowerOn()
+	} else if node.IsStopped() {
+		return fmt.Errorf("node is %s", node.StateName())
+	}
+
 	// Verify that we have a key available to this node
 	if !RegionKeyExists(node.KeyName, node.RegionId) {
 		return fmt.Errorf("key %s is not available locally",
 			node.KeyName)
 	}
 
-	// Verify that the node's security group exists
-	if !RegionSGExists(node.SGroup, node.RegionId) {
-		return fmt.Errorf("security group %s is not available", node.SGroup)
+	// Verify that each of the node's security groups exist. Groups are
+	// referenced by id since names are ambiguous across VPCs.
+	sgroups := make([]ec2.SecurityGroup, 0, len(node.SGroup))
+	for _, name := range node.SGroup {
+		if !RegionSGExists(name, node.Vpc, node.RegionId) {
+			return fmt.Errorf("security group %s is not available", name)
+		}
+		sg := RegionSG(name, node.Vpc, node.RegionId)
+		sgroups = append(sgroups, ec2.SecurityGroup{Id: sg.Id})
 	}
 
 	// Generate the userdata script for this node
@@ -124,38 +222,118 @@ func (node *Node) Start(masterIp string) error {
 		return err
 	}
 
-	// We only permit a single security group right now per-node
-	sgroups := []ec2.SecurityGroup{RegionSG(node.SGroup, node.RegionId).SecurityGroup}
+	// Work out the image, the disks and the zone, which may be pinned by
+	// existing persistent volumes.
+	err = node.ResolveAmi()
+	if err != nil {
+		return err
+	}
+	ami := node.AmiId
 
-	runInst := ec2.RunInstances{
-		ImageId:        node.Ami,
-		KeyName:        node.KeyName,
-		InstanceType:   node.Flavor,
-		UserData:       userData,
-		SecurityGroups: sgroups,
-		AvailZone:      node.Zone,
-		BlockDevices:   deviceMappings(node.Flavor)}
-	runResp, err := node.Conn().RunInstances(&runInst)
+	blockDevices, err := node.blockDeviceMappings(ami)
 	if err != nil {
-		return fmt.Errorf("launch failed: %+v\n", err)
+		return err
 	}
 
-	node.Instance = &(runResp.Instances[0])
+	zone, err := node.launchZone()
+	if err != nil {
+		return err
+	}
+
+	runInst := ec2.RunInstances{
+		ImageId:                  ami,
+		KeyName:                  node.KeyName,
+		InstanceType:             node.Flavor,
+		UserData:                 userData,
+		SecurityGroups:           sgroups,
+		AvailZone:                zone,
+		SubnetId:                 node.Subnet,
+		AssociatePublicIpAddress: isTrue(node.PublicIp),
+		PrivateIPAddress:         node.PrivateIp,
+		BlockDevices:             blockDevices,
+		IamInstanceProfile:       node.IamProfile,
+		DisableAPITermination:    isTrue(node.TerminationProtection),
+		EbsOptimized:             isTrue(node.EbsOptimized),
+		Monitoring:               isTrue(node.Monitoring),
+		PlacementGroupName:       node.PlacementGroup,
+		Tenancy:                  node.Tenancy,
+		ShutdownBehavior:         node.ShutdownBehavior}
+
+	// Spot nodes bid for an instance first, optionally falling back to an
+	// on-demand instance if the bid is not fulfilled in time.
+	if node.IsSpot() {
+		err = node.startSpot(&runInst)
+		if err == errSpotTimeout && isTrue(node.SpotFallback) {
+			printf("%s: spot request timed out; launching on-demand\n",
+				node.Name)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if node.Instance == nil {
+		runResp, err := node.Conn().RunInstances(&runInst)
+		if err != nil {
+			return fmt.Errorf("launch failed: %+v\n", err)
+		}
+
+		node.Instance = &(runResp.Instances[0])
+	}
 
 	printf("%s (%s): started\n", node.Name, node.Instance.InstanceId)
 
-	// Instance is now running; apply any tags
-	return node.ApplyTags()
+	// Instance is now running; apply any tags and record the AMI, which
+	// may have been looked up rather than configured directly
+	err = node.ApplyTags()
+	if err != nil {
+		return err
+	}
+
+	return node.tagAmi(ami)
+}
+
+// Records the AMI the node's instance was launched from, which later
+// commands compare against the config.
+func (node *Node) tagAmi(ami string) error {
+	_, err := node.Conn().CreateTags([]string{node.Instance.InstanceId},
+		withClusterTag(ec2.Tag{Key: AMI_TAG, Value: ami}))
+	if err != nil {
+		return fmt.Errorf("Failed to tag %s with its AMI: %+v\n", node.Name,
+			err)
+	}
+	return nil
+}
+
+// Returns the address used to reach the node. Nodes inside a VPC without a
+// public address are only reachable on their private address.
+func (node *Node) Address() string {
+	switch {
+	case node.Instance == nil:
+		return ""
+	case node.Instance.DNSName != "":
+		return node.Instance.DNSName
+	case node.Instance.PublicIpAddress != "":
+		return node.Instance.PublicIpAddress
+	default:
+		return node.Instance.PrivateIpAddress
+	}
 }
 
 func (node *Node) Terminate() error {
-	// Terminate the node on AWS
-	if !node.IsRunning() {
+	// Terminate the node on AWS; stopped nodes are terminated too
+	if !node.IsRunning() && !node.IsStopped() {
 		return fmt.Errorf("node not running")
 	}
 
 	_, err := node.Conn().TerminateInstances([]string{node.Instance.InstanceId})
-	if err != nil {
+	if ec2Err, ok := err.(*ec2.Error); ok &&
+		ec2Err.Code == "OperationNotPermitted" {
+		return fmt.Errorf("%s is protected from termination; disable "+
+			"termination_protection and run 'aws ec2 "+
+			"modify-instance-attribute --instance-id %s "+
+			"--no-disable-api-termination' first", node.Name,
+			node.Instance.InstanceId)
+	} else if err != nil {
 		return err
 	}
 	printf("%s (%s): terminated\n", node.Name, node.Instance.InstanceId)
@@ -163,6 +341,49 @@ func (node *Node) Terminate() error {
 	return nil
 }
 
+// Starts a stopped node.
+func (node *Node) PowerOn() error {
+	if node.State() != STATE_STOPPED {
+		return fmt.Errorf("node is %s", node.StateName())
+	}
+
+	_, err := node.Conn().StartInstances(node.Instance.InstanceId)
+	if err != nil {
+		return err
+	}
+	printf("%s (%s): starting\n", node.Name, node.Instance.InstanceId)
+	return nil
+}
+
+// Stops a running node, keeping its instance and EBS volumes.
+func (node *Node) PowerOff() error {
+	if !node.IsRunning() {
+		return fmt.Errorf("node is %s", node.StateName())
+	}
+
+	node.SshClose()
+	_, err := node.Conn().StopInstances(node.Instance.InstanceId)
+	if err != nil {
+		return err
+	}
+	printf("%s (%s): stopping\n", node.Name, node.Instance.InstanceId)
+	return nil
+}
+
+// Reboots a running node.
+func (node *Node) Reboot() error {
+	if !node.IsRunning() {
+		return fmt.Errorf("node is %s", node.StateName())
+	}
+
+	_, err := node.Conn().RebootInstances(node.Instance.InstanceId)
+	if err != nil {
+		return err
+	}
+	printf("%s (%s): rebooting\n", node.Name, node.Instance.InstanceId)
+	return nil
+}
+
 func (node *Node) SshOpen() error {
 	if !node.IsRunning() {
 		return fmt.Errorf("node not running")
@@ -174,7 +395,7 @@ func (node *Node) SshOpen() error {
 			Auth: PublicKeyAuth(RegionKey(node.KeyName, node.RegionId)),
 		}
 
-		client, err := ssh.Dial("tcp", node.Instance.DNSName+":22", &config)
+		client, err := ssh.Dial("tcp", node.Address()+":22", &config)
 		if err != nil {
 			return err
 		}
@@ -253,9 +474,11 @@ func (node *Node) SshUpload(remoteFilename string, data []byte) error {
 func (node *Node) ec2Tags() []ec2.Tag {
 	result := []ec2.Tag{ec2.Tag{Key: "Name", Value: node.Name}}
 	for key, value := range node.Tags {
-		result = append(result, ec2.Tag{Key: key, Value: value})
+		if key != CLUSTER_TAG {
+			result = append(result, ec2.Tag{Key: key, Value: value})
+		}
 	}
-	return result
+	return withClusterTag(result...)
 }
 
 func (node *Node) ApplyTags() error {
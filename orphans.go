@@ -0,0 +1,175 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// An instance salter launched that no longer matches a configured node.
+type Orphan struct {
+	Name     string
+	RegionId string
+	Instance ec2.Instance
+}
+
+// Returns how long the orphan has been running, to the minute.
+func (o *Orphan) Age() time.Duration {
+	return time.Since(o.Instance.LaunchTime) / time.Minute * time.Minute
+}
+
+// Lists, and with "terminate" tears down, instances that salter launched for
+// nodes that have since been removed from the config or moved to another
+// region, such as those left behind when a count is lowered.
+func orphans() error {
+	terminate := false
+	switch {
+	case len(G_ARGS) == 0:
+	case len(G_ARGS) == 1 && G_ARGS[0] == "terminate":
+		terminate = true
+	default:
+		errorf("usage: salter orphans [terminate]\n")
+		return fmt.Errorf("invalid arguments %v", G_ARGS)
+	}
+
+	found, err := findOrphans()
+	if err != nil {
+		errorf("Unable to list instances: %+v\n", err)
+		return err
+	}
+
+	if len(found) == 0 {
+		printf("No orphaned instances.\n")
+		return nil
+	}
+
+	for _, o := range found {
+		printf("%s\t%s\t%s\t%s\t%s\t%s\n", o.Name, o.Instance.InstanceId,
+			o.RegionId, o.Instance.InstanceType, o.Instance.State.Name,
+			o.Age())
+	}
+
+	if !terminate {
+		return nil
+	} else if !confirm(fmt.Sprintf("Terminate %d orphaned instances?",
+		len(found))) {
+		return nil
+	}
+
+	// The master is only needed to revoke the keys of the orphans' minions.
+	// Names come from tags anyone may set, so only those the master holds a
+	// key for are revoked.
+	var keys map[string]bool
+	master := G_CONFIG.findNodeByRole("saltmaster")
+	if master != nil {
+		if err := master.Update(); err != nil || !master.IsRunning() {
+			printf("Master is not running; salt keys will not be revoked.\n")
+			master = nil
+		} else if keys, err = saltKeys(master); err != nil {
+			errorf("Salt keys will not be revoked; %+v\n", err)
+			master = nil
+		}
+	}
+
+	for _, o := range found {
+		region, err := GetRegion(o.RegionId)
+		if err != nil {
+			errorf("%s: not terminated; %+v\n", o.Name, err)
+			continue
+		}
+
+		_, err = region.Conn.TerminateInstances(
+			[]string{o.Instance.InstanceId})
+		if err != nil {
+			errorf("%s: not terminated; %+v\n", o.Name, err)
+			continue
+		}
+		printf("%s (%s): terminated\n", o.Name, o.Instance.InstanceId)
+
+		// An orphan left behind in another region shares its name, and so
+		// its minion id, with the live node; that key stays.
+		_, configured := G_CONFIG.Nodes[o.Name]
+		if master == nil || o.Name == "" || configured {
+			continue
+		} else if err = checkMinionId(o.Name); err != nil {
+			errorf("%s: not revoking salt key; %+v\n", o.Name, err)
+		} else if !keys[o.Name] {
+			printf("%s: not revoking salt key; the master has no key for "+
+				"it\n", o.Name)
+		} else if err = revokeSaltKey(master, o.Name); err != nil {
+			errorf("%s: unable to revoke salt key; %+v\n", o.Name, err)
+		}
+	}
+	return nil
+}
+
+// Finds the instances of this cluster in every region used by the config
+// whose name is not a node in that region. The result is sorted by name.
+func findOrphans() ([]Orphan, error) {
+	var found []Orphan
+	for _, regionId := range configRegions() {
+		region, err := GetRegion(regionId)
+		if err != nil {
+			return nil, err
+		}
+
+		filter := ec2.NewFilter()
+		addClusterFilter(filter)
+		filter.Add("instance-state-code",
+			fmt.Sprint(STATE_PENDING), fmt.Sprint(STATE_RUNNING),
+			fmt.Sprint(STATE_STOPPING), fmt.Sprint(STATE_STOPPED))
+		resp, err := region.Conn.Instances(nil, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				name, _ := findTag(instance.Tags, "Name")
+				node, configured := G_CONFIG.Nodes[name]
+				if configured && node.RegionId == regionId {
+					continue
+				}
+				found = append(found, Orphan{name, regionId, instance})
+			}
+		}
+	}
+
+	sort.Sort(orphansByName(found))
+	return found, nil
+}
+
+type orphansByName []Orphan
+
+func (o orphansByName) Len() int      { return len(o) }
+func (o orphansByName) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o orphansByName) Less(i, j int) bool {
+	if o[i].Name != o[j].Name {
+		return o[i].Name < o[j].Name
+	}
+	return o[i].Instance.InstanceId < o[j].Instance.InstanceId
+}
@@ -0,0 +1,217 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Nodes are launched in parallel, so this keeps several nodes in the same VPC
+// from each creating a peering connection.
+var peeringLock sync.Mutex
+
+// Returns the id of the VPC the node is launched into; its own, the default
+// VPC of its region or none for EC2-Classic.
+func (node *Node) vpcId() (string, error) {
+	region, err := GetRegion(node.RegionId)
+	if err != nil {
+		return "", err
+	}
+	return region.vpcId(node.Vpc), nil
+}
+
+// Returns the address the node should use to reach the master. This is the
+// master's private address if they share a network, either by being in the
+// same VPC or VPCs peered with each other, and its public address otherwise.
+func masterAddress(node *Node, master *Node) (string, error) {
+	if node.RegionId == master.RegionId {
+		nodeVpc, err := node.vpcId()
+		if err != nil {
+			return "", err
+		}
+		masterVpc, err := master.vpcId()
+		if err != nil {
+			return "", err
+		} else if nodeVpc == masterVpc {
+			return master.Instance.PrivateIpAddress, nil
+		}
+
+		var peering *ec2.VpcPeeringConnection
+		if isTrue(node.VpcPeering) {
+			peering, err = ensurePeering(node, master, nodeVpc, masterVpc)
+		} else {
+			peering, err = findPeering(node.Conn(), nodeVpc, masterVpc,
+				"active")
+		}
+		if err != nil {
+			return "", err
+		} else if peering != nil {
+			return master.Instance.PrivateIpAddress, nil
+		}
+	} else if isTrue(node.VpcPeering) {
+		return "", fmt.Errorf("vpc_peering requires %s to be in %s",
+			master.Name, node.RegionId)
+	}
+
+	if master.Instance.PublicIpAddress == "" {
+		return "", fmt.Errorf("%s has no public address that %s can reach; "+
+			"give it a public_ip or an eip", master.Name, node.Name)
+	}
+	return master.Instance.PublicIpAddress, nil
+}
+
+// Finds the peering connection between two VPCs, in either direction, whose
+// status is one of the given codes. This returns nil if there is none.
+func findPeering(conn *ec2.EC2, vpcA, vpcB string, codes ...string) (*ec2.VpcPeeringConnection, error) {
+	if vpcA == "" || vpcB == "" {
+		return nil, nil
+	}
+
+	for _, pair := range [][2]string{{vpcA, vpcB}, {vpcB, vpcA}} {
+		filter := ec2.NewFilter()
+		filter.Add("requester-vpc-info.vpc-id", pair[0])
+		filter.Add("accepter-vpc-info.vpc-id", pair[1])
+		filter.Add("status-code", codes...)
+		resp, err := conn.DescribeVpcPeeringConnection(nil, filter)
+		if err != nil {
+			return nil, err
+		} else if len(resp.VpcPeeringConnections) > 0 {
+			return &resp.VpcPeeringConnections[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// Peers the node's VPC with the master's, accepting the connection and
+// routing each VPC's CIDR block to the other through it from the node's and
+// the master's subnets.
+func ensurePeering(node *Node, master *Node, nodeVpc, masterVpc string) (*ec2.VpcPeeringConnection, error) {
+	if nodeVpc == "" || masterVpc == "" {
+		return nil, fmt.Errorf("vpc_peering requires both %s and the master "+
+			"to be in a VPC", node.Name)
+	}
+
+	peeringLock.Lock()
+	defer peeringLock.Unlock()
+
+	conn := node.Conn()
+	// A connection still waiting to be accepted is picked up again rather
+	// than requested twice.
+	peering, err := findPeering(conn, nodeVpc, masterVpc, "active",
+		"pending-acceptance")
+	if err != nil {
+		return nil, err
+	}
+
+	if peering == nil {
+		resp, err := conn.CreateVpcPeeringConnection(
+			&ec2.CreateVpcPeeringConnection{
+				VpcId:     nodeVpc,
+				PeerVpcId: masterVpc})
+		if err != nil {
+			return nil, fmt.Errorf("unable to peer %s with %s: %+v", nodeVpc,
+				masterVpc, err)
+		}
+		peering = &resp.VpcPeeringConnection
+		printf("%s: peered %s with %s (%s)\n", node.Name, nodeVpc, masterVpc,
+			peering.VpcPeeringConnectionId)
+	}
+
+	if peering.Status.Code != "active" {
+		_, err = conn.AcceptVpcPeeringConnection(
+			peering.VpcPeeringConnectionId)
+		if err != nil {
+			return nil, fmt.Errorf("unable to accept %s: %+v",
+				peering.VpcPeeringConnectionId, err)
+		}
+	}
+
+	vpcResp, err := conn.DescribeVpcs([]string{nodeVpc, masterVpc}, nil)
+	if err != nil {
+		return nil, err
+	}
+	cidrs := make(map[string]string)
+	for _, vpc := range vpcResp.VPCs {
+		cidrs[vpc.VpcId] = vpc.CidrBlock
+	}
+
+	err = routeToPeer(conn, nodeVpc, node.Subnet, cidrs[masterVpc], peering)
+	if err != nil {
+		return nil, err
+	}
+	err = routeToPeer(conn, masterVpc, master.Instance.SubnetId,
+		cidrs[nodeVpc], peering)
+	if err != nil {
+		return nil, err
+	}
+	return peering, nil
+}
+
+// Adds a route for cidr through the peering connection to the route table
+// of the subnet, unless it already has one. Subnets without a table of their
+// own use the VPC's main table, as do instances launched without a subnet,
+// which go into a default subnet.
+func routeToPeer(conn *ec2.EC2, vpcId, subnetId, cidr string, peering *ec2.VpcPeeringConnection) error {
+	filter := ec2.NewFilter()
+	filter.Add("vpc-id", vpcId)
+	resp, err := conn.DescribeRouteTables(nil, filter)
+	if err != nil {
+		return err
+	}
+
+	var table, mainTable *ec2.RouteTable
+	for i := range resp.RouteTables {
+		for _, assoc := range resp.RouteTables[i].Associations {
+			if subnetId != "" && assoc.SubnetId == subnetId {
+				table = &resp.RouteTables[i]
+			} else if assoc.Main {
+				mainTable = &resp.RouteTables[i]
+			}
+		}
+	}
+	if table == nil {
+		table = mainTable
+	}
+	if table == nil {
+		return fmt.Errorf("%s has no main route table", vpcId)
+	}
+
+	for _, route := range table.Routes {
+		if route.DestinationCidrBlock == cidr {
+			return nil
+		}
+	}
+
+	_, err = conn.CreateRoute(&ec2.CreateRoute{
+		RouteTableId:           table.RouteTableId,
+		DestinationCidrBlock:   cidr,
+		VpcPeeringConnectionId: peering.VpcPeeringConnectionId})
+	if err != nil {
+		return fmt.Errorf("unable to route %s in %s: %+v", cidr,
+			table.RouteTableId, err)
+	}
+	return nil
+}
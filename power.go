@@ -0,0 +1,274 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stops the target nodes and waits for them to reach the stopped state.
+func stop() error {
+	failed := 0
+	var failedLock sync.Mutex
+	pForEachValue(G_TARGETS, func(node *Node) error {
+		err := stopNode(node)
+		if err != nil {
+			printf("%s: not stopped; %+v\n", node.Name, err)
+			failedLock.Lock()
+			failed++
+			failedLock.Unlock()
+			return err
+		}
+
+		printf("%s (%s): stopped\n", node.Name, node.Instance.InstanceId)
+		return nil
+	}, ARG_PARALLEL)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes not stopped", failed,
+			len(G_TARGETS))
+	}
+	return nil
+}
+
+func stopNode(node *Node) error {
+	err := node.Update()
+	if err != nil {
+		return err
+	}
+
+	err = node.PowerOff()
+	if err != nil {
+		return err
+	}
+
+	return waitForState(node, STATE_STOPPED)
+}
+
+// Starts the stopped target nodes and waits for them to come back into the
+// salt cluster.
+func start() error {
+	return powerCycle("started", func(node *Node) error {
+		return node.PowerOn()
+	})
+}
+
+// Reboots the target nodes and waits for them to come back into the salt
+// cluster.
+func reboot() error {
+	return powerCycle("rebooted", func(node *Node) error {
+		// Remember which boot the node is on so that we can tell when
+		// it has actually gone down and come back.
+		bootId, err := node.bootId()
+		if err != nil {
+			debugf("%s: unable to read boot id: %+v\n", node.Name, err)
+		}
+		node.SshClose()
+
+		err = node.Reboot()
+		if err != nil {
+			return err
+		}
+		return waitForReboot(node, bootId)
+	})
+}
+
+// Applies fn to each target node and then waits for the node to be running,
+// reachable via SSH and for its salt-minion to answer the master. If the
+// master is one of the targets it is handled first so that the other nodes
+// have something to report back to.
+func powerCycle(verb string, fn func(*Node) error) error {
+	cycle := func(node *Node, master *Node) error {
+		err := node.Update()
+		if err != nil {
+			return err
+		}
+
+		err = fn(node)
+		if err != nil {
+			return err
+		}
+
+		err = waitForRunning(node)
+		if err != nil {
+			captureConsole(node)
+			return err
+		}
+
+		// Classic instances lose their elastic IP when stopped.
+		err = node.AssociateAddress()
+		if err != nil {
+			return err
+		}
+
+		if master == nil {
+			printf("%s: not waiting for salt-minion; no running master\n",
+				node.Name)
+		} else if err = waitForMinion(node, master); err != nil {
+			return err
+		}
+
+		printf("%s (%s): %s\n", node.Name, node.Address(), verb)
+		return nil
+	}
+
+	// Handle the master first.
+	master := G_CONFIG.findNodeByRole("saltmaster")
+	if master != nil {
+		if _, found := G_TARGETS[master.Name]; found {
+			oldIp, oldPublicIp := "", ""
+			if err := master.Update(); err == nil {
+				oldIp, oldPublicIp = masterAddresses(master)
+			}
+
+			if err := cycle(master, master); err != nil {
+				printf("%s: not %s; %+v\n", master.Name, verb, err)
+				return err
+			}
+			warnMasterMoved(master, oldIp, oldPublicIp)
+		}
+
+		if err := master.Update(); err != nil || !master.IsRunning() {
+			master = nil
+		} else if err := master.SshOpen(); err != nil {
+			errorf("Unable to open SSH connection to master: %+v\n", err)
+			master = nil
+		}
+	}
+
+	targets := make(map[string]*Node, len(G_TARGETS))
+	for name, node := range G_TARGETS {
+		if master == nil || name != master.Name {
+			targets[name] = node
+		}
+	}
+
+	failed := 0
+	var failedLock sync.Mutex
+	pForEachValue(targets, func(node *Node) error {
+		err := cycle(node, master)
+		if err != nil {
+			printf("%s: not %s; %+v\n", node.Name, verb, err)
+			failedLock.Lock()
+			failed++
+			failedLock.Unlock()
+		}
+		return err
+	}, ARG_PARALLEL)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes not %s", failed, len(targets), verb)
+	}
+	return nil
+}
+
+// Returns the private and public addresses the minions reach the master on,
+// which are empty if it has no instance.
+func masterAddresses(master *Node) (string, string) {
+	if master.Instance == nil {
+		return "", ""
+	}
+	return master.Instance.PrivateIpAddress, master.Instance.PublicIpAddress
+}
+
+// Warns when restarting the master has moved it away from the addresses the
+// minions know it by.
+func warnMasterMoved(master *Node, oldIp, oldPublicIp string) {
+	newIp, newPublicIp := masterAddresses(master)
+
+	// The minions find the master via /etc/hosts, so a new address leaves
+	// them unable to reach it.
+	if oldIp != "" && oldIp != newIp {
+		printf("WARNING: %s moved from %s to %s; minions must be "+
+			"updated to reach it.\n", master.Name, oldIp, newIp)
+	}
+	// Minions in other regions use its public address.
+	if oldPublicIp != "" && oldPublicIp != newPublicIp {
+		printf("WARNING: %s moved from %s to %s; minions in other "+
+			"regions must be updated to reach it.\n", master.Name,
+			oldPublicIp, newPublicIp)
+	}
+}
+
+// Polls AWS until the node's instance reaches the given state.
+func waitForState(node *Node, state int) error {
+	for {
+		err := node.Update()
+		if err != nil {
+			return fmt.Errorf("AWS status update failed - %+v", err)
+		} else if node.Instance == nil {
+			return fmt.Errorf("instance has gone away")
+		} else if node.State() == state {
+			return nil
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Returns the kernel's boot id for the node, which changes on every boot.
+func (node *Node) bootId() (string, error) {
+	out, err := node.SshRunOutput("cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Waits for the node to come back from a reboot. If the previous boot id is
+// known this waits until the node reports a different one, otherwise it
+// gives the node some time to go down before continuing.
+func waitForReboot(node *Node, bootId string) error {
+	if bootId == "" {
+		time.Sleep(30 * time.Second)
+		return nil
+	}
+
+	for counter := 60; counter >= 0; counter-- {
+		time.Sleep(5 * time.Second)
+
+		newBootId, err := node.bootId()
+		node.SshClose()
+		if err == nil && newBootId != bootId {
+			return nil
+		}
+	}
+	return fmt.Errorf("wait for reboot timed out")
+}
+
+// Waits for the node's salt-minion to respond to the master.
+func waitForMinion(node *Node, master *Node) error {
+	cmd := fmt.Sprintf("sudo salt '%s' --output=txt test.ping", node.Name)
+	for counter := 24; counter >= 0; counter-- {
+		out, err := master.SshRunOutput(cmd)
+		if err == nil && strings.Contains(string(out), "True") {
+			return nil
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("wait for salt-minion timed out")
+}
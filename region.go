@@ -23,6 +23,7 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 	"sync"
 
@@ -34,7 +35,11 @@ type Region struct {
 	Keys map[string]Key // Key name -> Key (key.go)
 	Conn ec2.EC2
 
-	SGroups map[string]RegionalSGroup // SG name -> Info
+	SGroups map[string]RegionalSGroup // sgKey(VPC, SG name) -> Info
+
+	// The id of the default VPC for this region, if the account has one.
+	// Security groups that are not explicitly placed in a VPC end up here.
+	DefaultVpcId string
 
 	dataDir string
 }
@@ -111,38 +116,84 @@ func RegionKey(name string, regionId string) Key {
 	return key
 }
 
-func RegionSGExists(name string, regionId string) bool {
+// Security group names are only unique within a VPC, so the regional cache
+// is keyed by both the VPC id and the name. Groups outside of any VPC
+// (EC2-Classic) are keyed by name alone.
+func sgKey(vpcId, name string) string {
+	if vpcId == "" {
+		return name
+	}
+	return vpcId + "/" + name
+}
+
+// Returns the VPC that a security group without an explicit VPC will be
+// placed in for this region.
+func (r *Region) vpcId(vpcId string) string {
+	if vpcId == "" {
+		return r.DefaultVpcId
+	}
+	return vpcId
+}
+
+// Returns true if the group exists and belongs to this cluster.
+func RegionSGExists(name string, vpcId string, regionId string) bool {
 	region, _ := GetRegion(regionId)
-	_, found := region.SGroups[name]
-	return found
+	sg, found := region.SGroups[sgKey(region.vpcId(vpcId), name)]
+	return found && checkSGroupCluster(sg) == nil
+}
+
+// Checks that a security group belongs to this cluster. The default group of
+// each VPC is created by AWS and shared by everything in the VPC, so it is
+// the one group that may be used without the cluster tag.
+func checkSGroupCluster(sg RegionalSGroup) error {
+	if sg.Name == "default" {
+		return nil
+	}
+	return checkCluster(fmt.Sprintf("security group %s (%s)", sg.Name,
+		sg.Id), sg.Tags)
 }
 
-func RegionSG(name string, regionId string) RegionalSGroup {
+func RegionSG(name string, vpcId string, regionId string) RegionalSGroup {
 	region, _ := GetRegion(regionId)
-	sg := region.SGroups[name]
+	sg := region.SGroups[sgKey(region.vpcId(vpcId), name)]
 	return sg
 }
 
-func RegionSGEnsureExists(name string, regionId string) (*RegionalSGroup, error) {
+func RegionSGEnsureExists(name string, vpcId string, regionId string) (*RegionalSGroup, error) {
 	region, _ := GetRegion(regionId)
+	vpcId = region.vpcId(vpcId)
 	var sg RegionalSGroup
-	sg, found := region.SGroups[name]
-	if !found {
+	sg, found := region.SGroups[sgKey(vpcId, name)]
+	if found {
+		// Groups of other clusters are left alone; their rules are not
+		// ours to change.
+		if err := checkSGroupCluster(sg); err != nil {
+			return nil, err
+		}
+	} else {
 		// Create the SG
-		// TODO: Need to add support for VPC here?
 		sg.Name = name
 		sg.SecurityGroup.Description = name
+		sg.SecurityGroup.VpcId = vpcId
 		sgResp, err := region.Conn.CreateSecurityGroup(sg.SecurityGroup)
 		if err != nil {
 			return nil, err
 		}
 
-		debugf("Created security group %s-%s\n", regionId, name)
+		debugf("Created security group %s-%s\n", regionId, sgKey(vpcId, name))
 
+		_, err = region.Conn.CreateTags([]string{sgResp.Id}, withClusterTag())
+		if err != nil {
+			return nil, fmt.Errorf("unable to tag %s: %+v", sgResp.Id, err)
+		}
+
+		// The create response only carries the id and name, so retain
+		// the VPC the group was created in.
 		sg.RegionId = regionId
 		sg.SecurityGroup = sgResp.SecurityGroup
-		region.SGroups[name] = sg
-		return &sg, nil
+		sg.SecurityGroup.VpcId = vpcId
+		sg.SecurityGroup.Tags = withClusterTag()
+		region.SGroups[sgKey(vpcId, name)] = sg
 	}
 	return &sg, nil
 }
@@ -150,6 +201,7 @@ func RegionSGEnsureExists(name string, regionId string) (*RegionalSGroup, error)
 func (r *Region) Refresh() error {
 	rKeys := make(map[string]Key)
 	rSgroups := make(map[string]RegionalSGroup)
+	rDefaultVpcId := ""
 
 	var lastErr *error = nil
 
@@ -201,11 +253,8 @@ func (r *Region) Refresh() error {
 		}
 
 		for _, group := range sgroupResp.Groups {
-			// If the group is associated with a VPC we ignore it
-			//if group.VpcId != "" {
-			//	continue
-			//}
-			rSgroups[group.Name] = RegionalSGroup{group, r.Conn.Region.Name}
+			rSgroups[sgKey(group.VpcId, group.Name)] =
+				RegionalSGroup{group, r.Conn.Region.Name}
 		}
 
 		// Insert amazon-elb as a valid group
@@ -215,6 +264,23 @@ func (r *Region) Refresh() error {
 		//rSgroups["amazon-elb-sg"] = amazonElbSg
 	}()
 
+	// Find the default VPC, if there is one
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		filter := ec2.NewFilter()
+		filter.Add("isDefault", "true")
+		vpcResp, err := r.Conn.DescribeVpcs(nil, filter)
+		if err != nil {
+			lastErr = &err
+			return
+		}
+
+		if len(vpcResp.VPCs) > 0 {
+			rDefaultVpcId = vpcResp.VPCs[0].VpcId
+		}
+	}()
+
 	wg.Wait()
 	if lastErr != nil {
 		return *lastErr
@@ -224,6 +290,7 @@ func (r *Region) Refresh() error {
 	// region
 	r.Keys = rKeys
 	r.SGroups = rSgroups
+	r.DefaultVpcId = rDefaultVpcId
 	return nil
 }
 
@@ -0,0 +1,175 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/BurntSushi/ty/fun"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Changes the instance type of each target node whose flavor differs from
+// the config. Resizing requires stopping the instance, so nodes are resized
+// one at a time, and the first failure stops the run, so that the rest of
+// the cluster stays available. The master goes first so that the other
+// nodes have a master to report back to.
+func resize() error {
+	names := fun.Keys(G_TARGETS).([]string)
+	sort.Strings(names)
+
+	master := G_CONFIG.findNodeByRole("saltmaster")
+	if master != nil {
+		if _, found := G_TARGETS[master.Name]; found {
+			names = append([]string{master.Name},
+				fun.Filter(func(name string) bool {
+					return name != master.Name
+				}, names).([]string)...)
+		}
+	}
+
+	for _, name := range names {
+		node := G_TARGETS[name]
+		err := resizeNode(node, master)
+		if err != nil {
+			errorf("%s: not resized; %+v\n", node.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func resizeNode(node *Node, master *Node) error {
+	err := node.Update()
+	if err != nil {
+		return err
+	} else if node.Instance == nil {
+		printf("%s: not resized; node does not exist\n", node.Name)
+		return nil
+	} else if node.Instance.InstanceType == node.Flavor {
+		debugf("%s: already %s\n", node.Name, node.Flavor)
+		return nil
+	}
+
+	// Spot instances can not be stopped, so they must be relaunched instead.
+	if node.IsSpot() {
+		requests, err := node.SpotRequests("active")
+		if err != nil {
+			return fmt.Errorf("unable to list spot requests: %+v", err)
+		}
+		for _, request := range requests {
+			if request.InstanceId == node.Instance.InstanceId {
+				return fmt.Errorf("spot instances can not be resized; " +
+					"teardown and launch the node instead")
+			}
+		}
+	}
+
+	oldFlavor := node.Instance.InstanceType
+	oldIp, oldPublicIp := masterAddresses(node)
+	isMaster := master != nil && node.Name == master.Name
+	wasRunning := node.IsRunning()
+	if wasRunning {
+		node.SshClose()
+		err = node.PowerOff()
+		if err != nil {
+			return err
+		}
+	} else if node.State() != STATE_STOPPED {
+		return fmt.Errorf("node is %s", node.StateName())
+	}
+
+	err = waitForState(node, STATE_STOPPED)
+	if err != nil {
+		return err
+	}
+
+	_, err = node.Conn().ModifyInstance(node.Instance.InstanceId,
+		&ec2.ModifyInstance{InstanceType: node.Flavor})
+	if err != nil {
+		err = fmt.Errorf("unable to change instance type: %+v", err)
+		if wasRunning {
+			// Bring the node back as it was rather than leave it down.
+			if restartErr := restartNode(node); restartErr != nil {
+				errorf("%s: unable to restart as %s; %+v\n", node.Name,
+					oldFlavor, restartErr)
+			} else {
+				printf("%s: restarted as %s\n", node.Name, oldFlavor)
+				if isMaster {
+					warnMasterMoved(node, oldIp, oldPublicIp)
+				}
+			}
+		}
+		return err
+	}
+	printf("%s: resized from %s to %s\n", node.Name, oldFlavor, node.Flavor)
+
+	// Nodes that were stopped to begin with are left stopped.
+	if !wasRunning {
+		return nil
+	}
+
+	err = restartNode(node)
+	if err != nil {
+		return err
+	} else if isMaster {
+		warnMasterMoved(node, oldIp, oldPublicIp)
+	}
+
+	if master == nil {
+		printf("%s: not waiting for salt-minion; no master\n", node.Name)
+	} else {
+		// The master's SSH connection is stale if it was the node resized.
+		master.SshClose()
+		if err = master.Update(); err != nil {
+			return err
+		} else if !master.IsRunning() {
+			printf("%s: not waiting for salt-minion; master is not "+
+				"running\n", node.Name)
+		} else if err = waitForMinion(node, master); err != nil {
+			return err
+		}
+	}
+
+	printf("%s (%s): running as %s\n", node.Name, node.Address(),
+		node.Flavor)
+	return nil
+}
+
+// Starts a stopped node and waits for it to come up with its address.
+func restartNode(node *Node) error {
+	err := node.PowerOn()
+	if err != nil {
+		return err
+	}
+
+	err = waitForRunning(node)
+	if err != nil {
+		captureConsole(node)
+		return err
+	}
+
+	// Classic instances lose their elastic IP when stopped.
+	return node.AssociateAddress()
+}
@@ -26,11 +26,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"unicode/utf8"
+
+	"github.com/BurntSushi/ty/fun"
+	"golang.org/x/crypto/ssh"
 )
 
+// Values in the change report are cut down to this many characters.
+const HIGHSTATE_VALUE_WIDTH = 60
+
 // This is the JSON structure returned for each host after a highstate.
 type HighstateHost map[string]HighstateEntry
 
@@ -50,6 +57,51 @@ func (h HighstateHost) Summarize(host string) (states, changes, errors int) {
 	return
 }
 
+// Returns the keys of the host's states in the order salt ran them.
+func (h HighstateHost) ordered() []string {
+	keys := fun.Keys(h).([]string)
+	sort.Sort(highstateByRun{keys, h})
+	return keys
+}
+
+type highstateByRun struct {
+	keys []string
+	host HighstateHost
+}
+
+func (b highstateByRun) Len() int { return len(b.keys) }
+func (b highstateByRun) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+func (b highstateByRun) Less(i, j int) bool {
+	return b.host[b.keys[i]].RunNum < b.host[b.keys[j]].RunNum
+}
+
+// Displays the failed states of the host, followed by the changed ones.
+func (h HighstateHost) Report(host string) {
+	keys := h.ordered()
+	printf("%s:\n", host)
+	for _, key := range keys {
+		if entry := h[key]; !entry.Result {
+			printf("  FAILED  %s\n", entry.describe(key))
+			printIndented("    ", entry.Comment)
+			if retcode, found := entry.Changes["retcode"]; found {
+				printf("    retcode: %v\n", retcode)
+			}
+			if stderr, ok := entry.Changes["stderr"].(string); ok && stderr != "" {
+				printf("    stderr:\n")
+				printIndented("      ", stderr)
+			}
+		}
+	}
+	for _, key := range keys {
+		if entry := h[key]; entry.Result && len(entry.Changes) > 0 {
+			printf("  CHANGED %s\n", entry.describe(key))
+			printChanges("    ", entry.Changes)
+		}
+	}
+}
+
 // This is a specific item from a host's highstate report. This structure
 // is defined by the salt API. Each state is represented in a HighstateEntry.
 type HighstateEntry struct {
@@ -60,10 +112,104 @@ type HighstateEntry struct {
 	Changes map[string]interface{} `json:"changes"`
 
 	// True if the state executed successfully.
-	Result bool `jason:"result"`
+	Result bool `json:"result"`
+
+	// The name the state was applied to (a package, file path etc).
+	Name string `json:"name"`
+
+	// The order the state was run in.
+	RunNum int `json:"__run_num__"`
+}
+
+// Describes the state as "id (module.function: name)". Salt keys each state
+// by "module_|-id_|-name_|-function".
+func (e HighstateEntry) describe(key string) string {
+	parts := strings.Split(key, "_|-")
+	if len(parts) != 4 {
+		return key
+	}
+
+	name := e.Name
+	if name == "" {
+		name = parts[2]
+	}
+	return fmt.Sprintf("%s (%s.%s: %s)", parts[1], parts[0], parts[3], name)
+}
+
+// Prints each line of text with the given indent.
+func printIndented(indent, text string) {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		printf("%s%s\n", indent, line)
+	}
+}
+
+// Prints a compact diff of a state's changes. Changes salt reports as old and
+// new values are shown as "key: old -> new", and text that spans lines, like
+// the diff of a file, is shown below its key; anything else is shown as is.
+// Nested changes, such as those of each package in a pkg state, are shown
+// one level deeper.
+func printChanges(indent string, changes map[string]interface{}) {
+	keys := fun.Keys(changes).([]string)
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch value := changes[key].(type) {
+		case map[string]interface{}:
+			oldValue, hasOld := value["old"]
+			newValue, hasNew := value["new"]
+			if (hasOld || hasNew) && len(value) <= 2 {
+				printf("%s%s: %s -> %s\n", indent, key,
+					compactValue(oldValue), compactValue(newValue))
+			} else {
+				printf("%s%s:\n", indent, key)
+				printChanges(indent+"  ", value)
+			}
+		case string:
+			if strings.Contains(strings.TrimRight(value, "\n"), "\n") {
+				printf("%s%s:\n", indent, key)
+				printIndented(indent+"  ", value)
+			} else {
+				printf("%s%s: %s\n", indent, key, compactValue(value))
+			}
+		default:
+			printf("%s%s: %s\n", indent, key, compactValue(value))
+		}
+	}
+}
+
+// Formats a change value on a single line, cutting it short if needed.
+func compactValue(value interface{}) string {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		text = "-"
+	case string:
+		text = v
+		if text == "" {
+			text = "-"
+		}
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			text = fmt.Sprint(v)
+		} else {
+			text = string(raw)
+		}
+	}
+
+	text = strings.Replace(text, "\n", "\\n", -1)
+	if utf8.RuneCountInString(text) > HIGHSTATE_VALUE_WIDTH {
+		runes := []rune(text)
+		text = string(runes[:HIGHSTATE_VALUE_WIDTH-3]) + "..."
+	}
+	return text
 }
 
 // Attempts to SSH into 'master' in order to highstate the given targets.
+// This returns an error if the highstate failed on any host.
 func saltHighstate(master *Node, targets string) error {
 	if targets == "" {
 		// If the -s argument was not specified then we need to report the
@@ -72,12 +218,13 @@ func saltHighstate(master *Node, targets string) error {
 		os.Exit(1)
 	}
 
-	// Execute the SSH command.
+	// Execute the SSH command. Salt exits non-zero when states fail but
+	// still reports on every host, so only other errors are fatal.
 	cmd := fmt.Sprintf(
 		"sudo salt '%s' -t %d --output=json --static state.highstate",
 		targets, G_CONFIG.Salt.Timeout)
 	out, err := master.SshRunOutput(cmd)
-	if err != nil {
+	if _, ok := err.(*ssh.ExitError); err != nil && (!ok || len(out) == 0) {
 		debugf("Error during highstate process: %s\nMaster: %s\nCommand: %s\n",
 			err, master.Name, cmd)
 		return err
@@ -94,6 +241,12 @@ func saltHighstate(master *Node, targets string) error {
 	// This is the reporting output, indexed by host name.
 	report := make(map[string]string, 0)
 
+	// The details of hosts with failed or changed states, and the messages
+	// of hosts that returned an error instead of their states.
+	details := make(map[string]HighstateHost)
+	messages := make(map[string]string)
+	failed := 0
+
 	for host, raw := range hosts {
 		// First step is to try and parse the individual node response into
 		// a HighstateEntry item. If this succeeds then the result is a
@@ -101,20 +254,10 @@ func saltHighstate(master *Node, targets string) error {
 		// error message.
 		var items HighstateHost
 		if err := json.Unmarshal(raw, &items); err != nil {
-			if msg, err := json.MarshalIndent(raw, "", "\t"); err != nil {
-				// Inform the user.
-				debugf("Error highstating %s: %s\n", host, raw)
-
-				// Add a line to the report.
-				report[host] = "Error while highstating."
-			} else {
-				// Inform the user.
-				debugf("Bad JSON highstate reply while highstating %s:\n%s\n",
-					host, msg)
-
-				// Add a line to the report.
-				report[host] = "Error while highstating."
-			}
+			debugf("Error highstating %s: %s\n", host, raw)
+			report[host] = "Error while highstating."
+			messages[host] = highstateMessage(raw)
+			failed += 1
 			continue
 		}
 
@@ -127,6 +270,13 @@ func saltHighstate(master *Node, targets string) error {
 		// Add the results to the map we will display to the user.
 		report[host] = fmt.Sprintf("%d errors, %d changes, %d states.",
 			errors, changes, states)
+
+		if errors > 0 {
+			failed += 1
+		}
+		if errors > 0 || changes > 0 {
+			details[host] = items
+		}
 	}
 
 	// Walk through the keys (hostnames) calculating the longest name in the
@@ -150,6 +300,103 @@ func saltHighstate(master *Node, targets string) error {
 		printf("%s:%s%s\n", host, pad, report[host])
 	}
 
-	// Success
+	if failed == 0 {
+		return nil
+	}
+
+	// Explain what went wrong on each host, along with what did change so
+	// that the state the hosts were left in is clear.
+	for _, host := range keys {
+		if msg, found := messages[host]; found {
+			printf("\n%s:\n", host)
+			printIndented("  ", msg)
+		} else if items, found := details[host]; found {
+			printf("\n")
+			items.Report(host)
+		}
+	}
+
+	return fmt.Errorf("highstate failed on %d hosts", failed)
+}
+
+// Returns the error a host returned in place of its states, which salt gives
+// as a string or a list of strings.
+func highstateMessage(raw json.RawMessage) string {
+	var msg string
+	if err := json.Unmarshal(raw, &msg); err == nil {
+		return msg
+	}
+
+	var msgs []string
+	if err := json.Unmarshal(raw, &msgs); err == nil {
+		return strings.Join(msgs, "\n")
+	}
+	return string(raw)
+}
+
+// Where the master caches the data of each minion, including its mine.
+const SALT_MINION_CACHE_DIR = "/var/cache/salt/master/minions"
+
+// Minion ids that are safe to pass to salt-key and to use as a path in the
+// master's cache. Dots are allowed for fully qualified names, though not two
+// in a row, and glob characters are not, so an id only ever names one key.
+var MINION_ID_REGEXP = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]|\.[A-Za-z0-9_-])*$`)
+
+// Checks that a name can be used as a minion id on the master's command line.
+func checkMinionId(name string) error {
+	if !MINION_ID_REGEXP.MatchString(name) {
+		return fmt.Errorf("invalid minion id %q", name)
+	}
+	return nil
+}
+
+// Quotes a string for use as a single argument in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Lists the minion ids the master holds a key for, whether accepted, pending
+// or rejected.
+func saltKeys(master *Node) (map[string]bool, error) {
+	out, err := master.SshRunOutput(
+		"/usr/bin/sudo /usr/bin/salt-key -L --out=json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list keys: %+v", err)
+	}
+
+	var lists map[string][]string
+	if err = json.Unmarshal(out, &lists); err != nil {
+		return nil, fmt.Errorf("unable to parse key list: %+v", err)
+	}
+
+	keys := make(map[string]bool)
+	for _, ids := range lists {
+		for _, id := range ids {
+			keys[id] = true
+		}
+	}
+	return keys, nil
+}
+
+// Removes a minion's key and cached mine data from the master so that a new
+// instance with the same name can take its place.
+func revokeSaltKey(master *Node, name string) error {
+	err := checkMinionId(name)
+	if err != nil {
+		return err
+	}
+
+	err = master.SshRun("/usr/bin/sudo /usr/bin/salt-key -y -d " +
+		shellQuote(name))
+	if err != nil {
+		return fmt.Errorf("unable to delete key: %+v", err)
+	}
+
+	err = master.SshRun("/usr/bin/sudo rm -rf " +
+		shellQuote(SALT_MINION_CACHE_DIR+"/"+name))
+	if err != nil {
+		return fmt.Errorf("unable to remove mine cache: %+v", err)
+	}
+	printf("%s: revoked salt key\n", name)
 	return nil
 }
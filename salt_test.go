@@ -0,0 +1,85 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckMinionId(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"namenode1", true},
+		{"web-1_a", true},
+		{"web1.example.com", true},
+		{"", false},
+		{"*", false},
+		{"web*", false},
+		{"web?", false},
+		{"web[1]", false},
+		{"../etc", false},
+		{"a..b", false},
+		{".hidden", false},
+		{"trailing.", false},
+		{"a/b", false},
+		{"a b", false},
+		{"a\tb", false},
+		{"a;rm -rf /", false},
+		{"$(id)", false},
+		{"`id`", false},
+		{"a'b", false},
+		{"a|b", false},
+		{"a&b", false},
+	}
+
+	for _, test := range tests {
+		err := checkMinionId(test.name)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.name)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"", "''"},
+		{"web1", "'web1'"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$(id)", "'$(id)'"},
+	}
+
+	for _, test := range tests {
+		if quoted := shellQuote(test.in); quoted != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.in, test.expected,
+				quoted)
+		}
+	}
+}
@@ -27,13 +27,14 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/mitchellh/goamz/ec2"
 )
 
 type PermArray []ec2.IPPerm
 
-// For each target node, ensure that the security group exists in the
+// For each target node, ensure that its security groups exist in the
 // appropriate region and that the rules in local definition are present.
 func sgroups() error {
 	// This is a cache of all the security groups that have been verified
@@ -46,68 +47,46 @@ func sgroups() error {
 	setup_groups := make(map[string]bool)
 
 	// Walk through each node that we are touching and setup the security
-	// group attached to it (if we have not seen it already). Also create
+	// groups attached to it (if we have not seen them already). Also create
 	// security groups referenced by rules in this nodes config.
 	for _, node := range G_TARGETS {
-		sGroup := node.SGroup
-		if _, exist := setup_groups[sGroup]; exist {
-			// The group was setup in a prior iteration.
-			continue
-		}
-
-		// Get the security group form out cache. If the group is not in the
-		// cache then fetch it.
-		sg, ok := seen_groups[sGroup]
-		if !ok {
-			// The sgroup is not in the cache, fetch it from AWS. This call
-			// will create the group if it doesn't exist as well so after
-			// this the group should be configured at least.
-			var err error
-			sg, err = RegionSGEnsureExists(node.SGroup, node.RegionId)
-			if err != nil {
-				fatalf("%s: Failed to create security group %s: %#v\n",
-					node.Name, node.SGroup, err)
-			} else {
-				// Mark the group as having been checked.
-				seen_groups[sGroup] = sg
+		for _, sGroup := range node.SGroup {
+			// Groups with the same name may exist in several regions and
+			// VPCs, so they are tracked by all three values.
+			groupKey := node.RegionId + "/" + sgKey(node.Vpc, sGroup)
+			if _, exist := setup_groups[groupKey]; exist {
+				// The group was setup in a prior iteration.
+				continue
 			}
-		}
 
-		// Get the sgroup configuration that was added in the configuration
-		// file. If its not defined in the file then warn the user and move
-		// on.
-		sgConf, found := G_CONFIG.SGroups[sGroup]
-		if !found {
-			// Warn that this group was not found in local config
-			debugf("%s: Security group %s is not defined in the config file.\n",
-				sg.RegionId, sg.Name)
-			continue
-		}
-
-		// Identify each rule that is not present in the live security
-		// group configuration in AWS. Each missing permission will get added
-		// to the missingPerms array so it can be added later.
-		missingPerms := make([]ec2.IPPerm, 0)
-		existingPerms := PermArray(sg.IPPerms)
-		for _, rule := range sgConf.Rules {
-			perms, err := parseSGRule(rule, sg.RegionId)
-			if err != nil {
-				fatalf("%s: Invalid rule (%s); %s\n", node.Name, rule, err)
-			}
-
-			// Walk through each of the returned permissions.
-			for _, perm := range perms {
-				if !existingPerms.contains(*perm) {
-					missingPerms = append(missingPerms, *perm)
+			// Get the security group form out cache. If the group is not in
+			// the cache then fetch it.
+			sg, ok := seen_groups[groupKey]
+			if !ok {
+				// The sgroup is not in the cache, fetch it from AWS. This
+				// call will create the group if it doesn't exist as well so
+				// after this the group should be configured at least.
+				var err error
+				sg, err = RegionSGEnsureExists(sGroup, node.Vpc, node.RegionId)
+				if err != nil {
+					fatalf("%s: Failed to create security group %s: %#v\n",
+						node.Name, sGroup, err)
+				} else {
+					// Mark the group as having been checked.
+					seen_groups[groupKey] = sg
 				}
 			}
-		}
 
-		// If any permissions are missing then we need to inform the user
-		// and then add them.
-		if len(missingPerms) > 0 {
-			printf("Adding %d missing rules to %s-%s\n",
-				len(missingPerms), sg.RegionId, sg.Name)
+			// Get the sgroup configuration that was added in the configuration
+			// file. If its not defined in the file then warn the user and move
+			// on.
+			sgConf, found := G_CONFIG.SGroups[sGroup]
+			if !found {
+				// Warn that this group was not found in local config
+				debugf("%s: Security group %s is not defined in the config "+
+					"file.\n", sg.RegionId, sg.Name)
+				continue
+			}
 
 			// Start by getting the region object from the cache.
 			region, err := GetRegion(sg.RegionId)
@@ -116,24 +95,90 @@ func sgroups() error {
 					sg.RegionId, err)
 			}
 
-			// And now add the various rules to the security group in the
-			// region.
-			_, err = region.Conn.AuthorizeSecurityGroup(sg.SecurityGroup,
-				missingPerms)
-			if err != nil {
-				fatalf("Unable to add missing rules for %s: %+v\n%+v\n",
-					sg.Name, err, missingPerms)
+			syncPerms(node, sg, "ingress", sgConf.Rules, sg.IPPerms,
+				region.Conn.AuthorizeSecurityGroup,
+				region.Conn.RevokeSecurityGroup)
+
+			// Egress rules are only managed when the config lists them, as
+			// AWS gives every VPC group an allow all egress rule by default.
+			if sgConf.Egress != nil {
+				if sg.VpcId == "" {
+					fatalf("%s: egress rules require a VPC security group\n",
+						sg.Name)
+				}
+				syncPerms(node, sg, "egress", sgConf.Egress, sg.IPPermsEgress,
+					region.Conn.AuthorizeSecurityGroupEgress,
+					region.Conn.RevokeSecurityGroupEgress)
 			}
-		}
 
-		// Mark the sgroup as having been setup so that we don't attempt to
-		// set it up again for another node in the same sgroup.
-		setup_groups[sGroup] = true
+			// Mark the sgroup as having been setup so that we don't attempt to
+			// set it up again for another node in the same sgroup.
+			setup_groups[groupKey] = true
+		}
 	}
 
 	return nil
 }
 
+// Brings one direction of a security group's live permissions in line with
+// the configured rules. Missing permissions are always added, while
+// permissions that are not in the config are only revoked in reconcile
+// mode, and only once the user has confirmed it.
+func syncPerms(node *Node, sg *RegionalSGroup, direction string,
+	rules []string, live []ec2.IPPerm,
+	authorize, revoke func(ec2.SecurityGroup, []ec2.IPPerm) (*ec2.SimpleResp, error)) {
+	// Expand the configured rules into the permissions they grant.
+	configured := make([]ec2.IPPerm, 0)
+	for _, rule := range rules {
+		perms, err := parseSGRule(rule, sg.RegionId, sg.VpcId)
+		if err != nil {
+			fatalf("%s: Invalid rule (%s); %s\n", node.Name, rule, err)
+		}
+		for _, perm := range perms {
+			configured = append(configured, *perm)
+		}
+	}
+
+	// Compare against the live security group configuration in AWS and
+	// show the user the difference.
+	missingPerms, extraPerms := diffPerms(configured, live)
+	if len(missingPerms) > 0 || len(extraPerms) > 0 {
+		printf("%s-%s (%s):\n", sg.RegionId, sg.Name, direction)
+		for _, perm := range missingPerms {
+			printf("  + %s\n", permString(perm))
+		}
+		for _, perm := range extraPerms {
+			printf("  - %s\n", permString(perm))
+		}
+	}
+
+	if len(missingPerms) > 0 {
+		printf("Adding %d missing %s rules to %s-%s\n",
+			len(missingPerms), direction, sg.RegionId, sg.Name)
+		_, err := authorize(sg.SecurityGroup, missingPerms)
+		if err != nil {
+			fatalf("Unable to add missing rules for %s: %+v\n%+v\n",
+				sg.Name, err, missingPerms)
+		}
+	}
+
+	if len(extraPerms) > 0 && !ARG_RECONCILE {
+		printf("%s-%s has %d %s rules not in the config; use -reconcile "+
+			"to revoke them\n", sg.RegionId, sg.Name, len(extraPerms),
+			direction)
+	} else if len(extraPerms) > 0 && confirm(fmt.Sprintf(
+		"Revoke %d %s rules from %s-%s?", len(extraPerms), direction,
+		sg.RegionId, sg.Name)) {
+		_, err := revoke(sg.SecurityGroup, extraPerms)
+		if err != nil {
+			fatalf("Unable to revoke rules for %s: %+v\n%+v\n",
+				sg.Name, err, extraPerms)
+		}
+		printf("Revoked %d %s rules from %s-%s\n", len(extraPerms),
+			direction, sg.RegionId, sg.Name)
+	}
+}
+
 // This function parses a string element from the sgroups section into
 // a list of rules. This returns a list because a single line can turn
 // into several rules via various expansion properties.
@@ -156,9 +201,13 @@ func sgroups() error {
 //     be larger or equal to from_port, except if the protocol is icmp and
 //     the to_port value is -1.
 // 'match' is either a CIDR network address, or the name of a security group.
+//     Groups of nodes in other regions become the public addresses of the
+//     nodes.
+//     For egress rules this is the destination rather than the source.
 //     this may also be a special value of '*' which will expand the rule into
 //     a series of rules that match all sgroups configured in the config file.
-func parseSGRule(rule, region string) ([]*ec2.IPPerm, error) {
+//     Security groups are looked up (or created) in the given region and vpc.
+func parseSGRule(rule, region, vpc string) ([]*ec2.IPPerm, error) {
 	// Checks a port string to see if it is within a proper range for
 	// tcp/udp ports. This takes the fromPort and toPort strings and returns
 	// an error if either does not make sense for a standard tcp or udp rule.
@@ -189,7 +238,7 @@ func parseSGRule(rule, region string) ([]*ec2.IPPerm, error) {
 				rule, toInt, fromInt)
 		} else if toInt > 65535 {
 			return 0, 0, fmt.Errorf(
-				"(%d): to_port can not be greater than 65535: %d", toInt)
+				"(%s): to_port can not be greater than 65535: %d", rule, toInt)
 		} else {
 			return fromInt, toInt, nil
 		}
@@ -292,14 +341,44 @@ func parseSGRule(rule, region string) ([]*ec2.IPPerm, error) {
 	ret := make([]*ec2.IPPerm, 0)
 
 	// If match is '*' then we need to iterate the list of all sgroups defined
-	// in the config file.
+	// in the config file. Security groups can not be referenced from another
+	// region, so nodes in other regions are matched by their public address
+	// instead.
 	matches := make(map[string]bool)
 	if match == "*" {
 		for _, node := range G_CONFIG.Nodes {
-			matches[node.SGroup] = true
+			if node.RegionId != region {
+				if cidr := remoteNodeCIDR(node); cidr != "" {
+					matches[cidr] = true
+				}
+				continue
+			}
+			for _, sGroup := range node.SGroup {
+				matches[sGroup] = true
+			}
 		}
-	} else {
+	} else if _, _, err := net.ParseCIDR(match); err == nil {
 		matches[match] = true
+	} else {
+		// The group is referenced directly if it is used in this region, or
+		// is not used by any node at all.
+		local, remote := false, false
+		for _, node := range G_CONFIG.Nodes {
+			if !node.SGroup.contains(match) {
+				continue
+			} else if node.RegionId == region {
+				local = true
+				continue
+			}
+
+			remote = true
+			if cidr := remoteNodeCIDR(node); cidr != "" {
+				matches[cidr] = true
+			}
+		}
+		if local || !remote {
+			matches[match] = true
+		}
 	}
 
 	// Walk through each of the matches adding them to the array of IPPerm
@@ -326,13 +405,13 @@ func parseSGRule(rule, region string) ([]*ec2.IPPerm, error) {
 				// security group. Start by checking to see if the security
 				// group exists so that we can warn the user that we are
 				// creating it otherwise.
-				if !RegionSGExists(match, region) {
+				if !RegionSGExists(match, vpc, region) {
 					debugf("Creating security group: %s", match)
 				}
 
 				// Fetch the region from the cache or create it if
 				// necessary.
-				sg, err := RegionSGEnsureExists(match, region)
+				sg, err := RegionSGEnsureExists(match, vpc, region)
 				if err != nil {
 					fatalf("Unable to make %s: %#v", match, err)
 				}
@@ -356,6 +435,98 @@ func parseSGRule(rule, region string) ([]*ec2.IPPerm, error) {
 	return ret, nil
 }
 
+// Splits permissions so that each one has a single source. AWS groups all of
+// the sources for a protocol and port range into one permission, while the
+// config has a rule per source.
+func explodePerms(perms []ec2.IPPerm) []ec2.IPPerm {
+	ret := make([]ec2.IPPerm, 0, len(perms))
+	for _, perm := range perms {
+		for _, ip := range perm.SourceIPs {
+			single := perm
+			single.SourceIPs = []string{ip}
+			single.SourceGroups = nil
+			ret = append(ret, single)
+		}
+		for _, group := range perm.SourceGroups {
+			single := perm
+			single.SourceIPs = nil
+			single.SourceGroups = []ec2.UserSecurityGroup{group}
+			ret = append(ret, single)
+		}
+	}
+	return ret
+}
+
+// Computes the permissions that are configured but not live (missing) and
+// the ones that are live but not configured (extra).
+func diffPerms(configured, live []ec2.IPPerm) (missing, extra []ec2.IPPerm) {
+	configured = explodePerms(configured)
+	live = explodePerms(live)
+
+	missing = make([]ec2.IPPerm, 0)
+	for _, perm := range configured {
+		if !PermArray(live).contains(perm) {
+			missing = append(missing, perm)
+		}
+	}
+
+	extra = make([]ec2.IPPerm, 0)
+	for _, perm := range live {
+		if !PermArray(configured).contains(perm) {
+			extra = append(extra, perm)
+		}
+	}
+	return missing, extra
+}
+
+// Formats a single source permission using the rule syntax of the config.
+func permString(perm ec2.IPPerm) string {
+	sources := make([]string, 0)
+	sources = append(sources, perm.SourceIPs...)
+	for _, group := range perm.SourceGroups {
+		if group.Name != "" {
+			sources = append(sources, group.Name)
+		} else {
+			sources = append(sources, group.Id)
+		}
+	}
+	return fmt.Sprintf("%s:%d:%d:%s", perm.Protocol, perm.FromPort,
+		perm.ToPort, strings.Join(sources, ","))
+}
+
+// The public addresses of nodes looked up by remoteNodeCIDR.
+var sgRemoteCIDRs map[string]string = make(map[string]string)
+var sgRemoteCIDRsLock sync.Mutex
+
+// Returns the public address of a node, as a CIDR, for use in rules of
+// security groups in other regions. A stopped node keeps the elastic IP it
+// gets back when started, so its rules are kept too. Nodes without an
+// instance or an address have none, so this returns an empty string and
+// sgroups needs to be run again once they have been launched.
+func remoteNodeCIDR(node *Node) string {
+	sgRemoteCIDRsLock.Lock()
+	defer sgRemoteCIDRsLock.Unlock()
+
+	if cidr, found := sgRemoteCIDRs[node.Name]; found {
+		return cidr
+	}
+
+	cidr := ""
+	if err := node.Update(); err != nil {
+		errorf("%s: unable to update status from AWS: %+v\n", node.Name, err)
+	} else if node.Instance != nil && node.Instance.PublicIpAddress != "" {
+		cidr = node.Instance.PublicIpAddress + "/32"
+	} else if ip, found := node.eipTag(); found {
+		cidr = ip + "/32"
+	} else {
+		debugf("%s: no public address to add to rules in other regions\n",
+			node.Name)
+	}
+
+	sgRemoteCIDRs[node.Name] = cidr
+	return cidr
+}
+
 func (perms PermArray) contains(perm ec2.IPPerm) bool {
 	compareString := func(s1, s2 []string) bool {
 		for _, d2 := range s2 {
@@ -0,0 +1,136 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+func TestParseSGRuleCIDR(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected []string
+	}{
+		{"tcp:22:10.0.0.0/8", []string{"tcp:22:22:10.0.0.0/8"}},
+		{"tcp:1024:65535:0.0.0.0/0", []string{"tcp:1024:65535:0.0.0.0/0"}},
+		{"tcp/udp:53:10.0.0.2/32",
+			[]string{"tcp:53:53:10.0.0.2/32", "udp:53:53:10.0.0.2/32"}},
+		{"icmp:ping:0.0.0.0/0", []string{"icmp:8:-1:0.0.0.0/0"}},
+		{"icmp:*:0.0.0.0/0", []string{"icmp:-1:-1:0.0.0.0/0"}},
+	}
+
+	for _, test := range tests {
+		perms, err := parseSGRule(test.rule, "us-west-2", "")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.rule, err)
+			continue
+		}
+
+		rules := make([]string, len(perms))
+		for i, perm := range perms {
+			rules[i] = permString(*perm)
+		}
+		if !reflect.DeepEqual(rules, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.rule, test.expected,
+				rules)
+		}
+	}
+
+	for _, rule := range []string{"tcp:0:10.0.0.0/8", "tcp:22:21:10.0.0.0/8",
+		"tcp:70000:10.0.0.0/8", "gre:10.0.0.0/8", "icmp:bogus:0.0.0.0/0",
+		"tcp"} {
+		if _, err := parseSGRule(rule, "us-west-2", ""); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
+
+func TestDiffPerms(t *testing.T) {
+	perm := func(protocol string, from, to int, ips []string,
+		groups ...string) ec2.IPPerm {
+		p := ec2.IPPerm{Protocol: protocol, FromPort: from, ToPort: to,
+			SourceIPs: ips}
+		for _, id := range groups {
+			p.SourceGroups = append(p.SourceGroups,
+				ec2.UserSecurityGroup{Id: id})
+		}
+		return p
+	}
+	permStrings := func(perms []ec2.IPPerm) []string {
+		ret := make([]string, len(perms))
+		for i, p := range perms {
+			ret[i] = permString(p)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		configured []ec2.IPPerm
+		live       []ec2.IPPerm
+		missing    []string
+		extra      []string
+	}{
+		// In sync.
+		{[]ec2.IPPerm{perm("tcp", 22, 22, []string{"10.0.0.0/8"})},
+			[]ec2.IPPerm{perm("tcp", 22, 22, []string{"10.0.0.0/8"})},
+			[]string{}, []string{}},
+		// AWS groups the sources of a port range into one permission.
+		{[]ec2.IPPerm{
+			perm("tcp", 22, 22, []string{"10.0.0.0/8"}),
+			perm("tcp", 22, 22, nil, "sg-1")},
+			[]ec2.IPPerm{perm("tcp", 22, 22, []string{"10.0.0.0/8"},
+				"sg-1")},
+			[]string{}, []string{}},
+		// A source of the live permission that is not configured.
+		{[]ec2.IPPerm{perm("tcp", 22, 22, []string{"10.0.0.0/8"})},
+			[]ec2.IPPerm{perm("tcp", 22, 22,
+				[]string{"10.0.0.0/8", "1.2.3.4/32"})},
+			[]string{}, []string{"tcp:22:22:1.2.3.4/32"}},
+		// Different ports or protocols are different permissions.
+		{[]ec2.IPPerm{perm("tcp", 80, 80, []string{"0.0.0.0/0"})},
+			[]ec2.IPPerm{perm("tcp", 8080, 8080, []string{"0.0.0.0/0"}),
+				perm("udp", 80, 80, []string{"0.0.0.0/0"})},
+			[]string{"tcp:80:80:0.0.0.0/0"},
+			[]string{"tcp:8080:8080:0.0.0.0/0", "udp:80:80:0.0.0.0/0"}},
+		// Groups are compared by id.
+		{[]ec2.IPPerm{perm("tcp", 0, 65535, nil, "sg-1")},
+			[]ec2.IPPerm{perm("tcp", 0, 65535, nil, "sg-2")},
+			[]string{"tcp:0:65535:sg-1"}, []string{"tcp:0:65535:sg-2"}},
+	}
+
+	for i, test := range tests {
+		missing, extra := diffPerms(test.configured, test.live)
+		got := permStrings(missing)
+		if !reflect.DeepEqual(got, test.missing) {
+			t.Errorf("%d: expected missing %v, got %v", i, test.missing,
+				got)
+		}
+		got = permStrings(extra)
+		if !reflect.DeepEqual(got, test.extra) {
+			t.Errorf("%d: expected extra %v, got %v", i, test.extra, got)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Tags applied to each snapshot. All of the volumes of a node snapshotted
+// in one run share the same set id, which is also the time of the run.
+const (
+	SNAPSHOT_NODE_TAG   = "Node"
+	SNAPSHOT_DEVICE_TAG = "Device"
+	SNAPSHOT_SET_TAG    = "SnapshotSet"
+	SNAPSHOT_SET_FORMAT = "20060102-150405"
+)
+
+// Snapshots every EBS volume of the target nodes and then prunes old
+// snapshots according to the retention policy.
+func snapshot() error {
+	set := time.Now().UTC().Format(SNAPSHOT_SET_FORMAT)
+	failed := 0
+	var failedLock sync.Mutex
+	pForEachValue(G_TARGETS, func(node *Node) error {
+		err := snapshotNode(node, set)
+		if err != nil {
+			failedLock.Lock()
+			failed++
+			failedLock.Unlock()
+		}
+		return err
+	}, ARG_PARALLEL)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes not snapshotted", failed,
+			len(G_TARGETS))
+	}
+	return nil
+}
+
+// Snapshots the node's volumes into the set and prunes its old sets.
+func snapshotNode(node *Node, set string) error {
+	err := node.Update()
+	if err != nil {
+		printf("%s: not snapshotted; %+v\n", node.Name, err)
+		return err
+	} else if node.Instance == nil {
+		printf("%s: not snapshotted; node does not exist\n", node.Name)
+		return nil
+	}
+
+	err = node.Snapshot(set)
+	if err != nil {
+		printf("%s: not snapshotted; %+v\n", node.Name, err)
+		return err
+	}
+
+	err = node.PruneSnapshots()
+	if err != nil {
+		printf("%s: unable to prune snapshots; %+v\n", node.Name, err)
+	}
+	return err
+}
+
+// Relaunches the target nodes with their volumes created from a snapshot
+// set; either the one given with -snapshot or the latest complete set.
+func restore() error {
+	updateNodes(G_TARGETS, ARG_PARALLEL)
+	for _, node := range G_TARGETS {
+		if node.Instance != nil {
+			errorf("%s already exists; tear it down before restoring.\n",
+				node.Name)
+			return fmt.Errorf("%s exists", node.Name)
+		}
+
+		// Persistent volumes outlive their instance, so restoring over one
+		// would silently keep the old data.
+		for i := range node.Volumes {
+			v := &node.Volumes[i]
+			if v.Name == "" {
+				continue
+			}
+			vol, err := node.findVolume(v)
+			if err != nil {
+				errorf("%s: %+v\n", node.Name, err)
+				return err
+			} else if vol != nil {
+				errorf("%s: volume %s (%s) already exists; delete it before "+
+					"restoring.\n", node.Name, node.volumeTagName(v),
+					vol.VolumeId)
+				return fmt.Errorf("%s exists", node.volumeTagName(v))
+			}
+		}
+
+		set, snapshots, err := node.findSnapshotSet(ARG_SNAPSHOT_SET)
+		if err != nil {
+			errorf("%s: %+v\n", node.Name, err)
+			return err
+		}
+
+		node.restoreSnapshots = make(map[string]string)
+		for _, snap := range snapshots {
+			device, _ := findTag(snap.Tags, SNAPSHOT_DEVICE_TAG)
+			node.restoreSnapshots[device] = snap.Id
+		}
+		printf("%s: restoring from snapshot set %s\n", node.Name, set)
+	}
+
+	return launch()
+}
+
+// Starts a snapshot of each of the node's EBS volumes.
+func (node *Node) Snapshot(set string) error {
+	for _, device := range node.Instance.BlockDevices {
+		if device.VolumeId == "" {
+			continue
+		}
+
+		description := fmt.Sprintf("%s %s %s", node.Name, device.DeviceName,
+			set)
+		resp, err := node.Conn().CreateSnapshot(device.VolumeId, description)
+		if err != nil {
+			return fmt.Errorf("unable to snapshot %s: %+v", device.VolumeId,
+				err)
+		}
+
+		tags := withClusterTag(
+			ec2.Tag{Key: "Name", Value: description},
+			ec2.Tag{Key: SNAPSHOT_NODE_TAG, Value: node.Name},
+			ec2.Tag{Key: SNAPSHOT_DEVICE_TAG, Value: device.DeviceName},
+			ec2.Tag{Key: SNAPSHOT_SET_TAG, Value: set},
+		)
+		_, err = node.Conn().CreateTags([]string{resp.Id}, tags)
+		if err != nil {
+			return fmt.Errorf("unable to tag %s: %+v", resp.Id, err)
+		}
+
+		printf("%s: snapshotting %s (%s) as %s\n", node.Name,
+			device.DeviceName, device.VolumeId, resp.Id)
+	}
+	return nil
+}
+
+// Returns all of the snapshots salter has taken of the node.
+func (node *Node) snapshots() ([]ec2.Snapshot, error) {
+	filter := ec2.NewFilter()
+	filter.Add("tag:"+SNAPSHOT_NODE_TAG, node.Name)
+	addClusterFilter(filter)
+	resp, err := node.Conn().Snapshots(nil, filter)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Snapshots, nil
+}
+
+// Groups snapshots by their set, returning the sets sorted oldest first.
+func snapshotSets(snapshots []ec2.Snapshot) ([]string, map[string][]ec2.Snapshot) {
+	sets := make(map[string][]ec2.Snapshot)
+	for _, snap := range snapshots {
+		set, _ := findTag(snap.Tags, SNAPSHOT_SET_TAG)
+		sets[set] = append(sets[set], snap)
+	}
+
+	names := make([]string, 0, len(sets))
+	for set := range sets {
+		names = append(names, set)
+	}
+	sort.Strings(names)
+	return names, sets
+}
+
+// Returns true if every snapshot in the set has completed.
+func snapshotSetComplete(snapshots []ec2.Snapshot) bool {
+	for _, snap := range snapshots {
+		if snap.Status != "completed" {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds the snapshots in the named set, or the latest set in which every
+// snapshot has completed if set is empty.
+func (node *Node) findSnapshotSet(set string) (string, []ec2.Snapshot, error) {
+	snapshots, err := node.snapshots()
+	if err != nil {
+		return "", nil, err
+	}
+
+	names, sets := snapshotSets(snapshots)
+	if set != "" {
+		if _, found := sets[set]; !found {
+			return "", nil, fmt.Errorf("no snapshot set %s", set)
+		} else if !snapshotSetComplete(sets[set]) {
+			return "", nil, fmt.Errorf("snapshot set %s is not complete", set)
+		}
+		return set, sets[set], nil
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		if snapshotSetComplete(sets[names[i]]) {
+			return names[i], sets[names[i]], nil
+		}
+	}
+	return "", nil, fmt.Errorf("no complete snapshot sets")
+}
+
+// Deletes the node's snapshot sets that fall outside of the retention
+// policy.
+func (node *Node) PruneSnapshots() error {
+	policy := G_CONFIG.Snapshots
+	if policy.Keep == 0 && policy.MaxAge == 0 {
+		return nil
+	}
+
+	snapshots, err := node.snapshots()
+	if err != nil {
+		return err
+	}
+
+	names, sets := snapshotSets(snapshots)
+	for _, set := range expiredSnapshotSets(names, sets, policy,
+		time.Now().UTC()) {
+		for _, snap := range sets[set] {
+			_, err = node.Conn().DeleteSnapshots([]string{snap.Id})
+			if err != nil {
+				return fmt.Errorf("unable to delete %s: %+v", snap.Id, err)
+			}
+			printf("%s: deleted snapshot %s from %s\n", node.Name, snap.Id,
+				set)
+		}
+	}
+	return nil
+}
+
+// Returns the sets, oldest first, that fall outside of the retention policy
+// at the given time. Only complete sets count towards the policy, so a
+// snapshot that is still in progress never pushes out the last good one, and
+// the newest complete set is always kept.
+func expiredSnapshotSets(names []string, sets map[string][]ec2.Snapshot,
+	policy SnapshotConfig, now time.Time) []string {
+	complete := make([]string, 0, len(names))
+	for _, set := range names {
+		if snapshotSetComplete(sets[set]) {
+			complete = append(complete, set)
+		}
+	}
+
+	expired := make([]string, 0)
+	cutoff := now.AddDate(0, 0, -policy.MaxAge)
+	for i, set := range complete {
+		if i == len(complete)-1 {
+			break
+		}
+
+		old := policy.Keep > 0 && i < len(complete)-policy.Keep
+		if policy.MaxAge > 0 {
+			created, err := time.Parse(SNAPSHOT_SET_FORMAT, set)
+			if err == nil && created.Before(cutoff) {
+				old = true
+			}
+		}
+		if old {
+			expired = append(expired, set)
+		}
+	}
+	return expired
+}
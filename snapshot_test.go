@@ -0,0 +1,98 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+func TestExpiredSnapshotSets(t *testing.T) {
+	now := time.Date(2014, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	// Builds a set of snapshots, one per status, tagged with the set id.
+	set := func(id string, statuses ...string) []ec2.Snapshot {
+		snapshots := make([]ec2.Snapshot, len(statuses))
+		for i, status := range statuses {
+			snapshots[i] = ec2.Snapshot{Status: status, Tags: []ec2.Tag{
+				{Key: SNAPSHOT_SET_TAG, Value: id}}}
+		}
+		return snapshots
+	}
+
+	tests := []struct {
+		sets     map[string][]ec2.Snapshot
+		policy   SnapshotConfig
+		expected []string
+	}{
+		// No sets at all.
+		{map[string][]ec2.Snapshot{}, SnapshotConfig{Keep: 1},
+			[]string{}},
+		// Keep the newest two.
+		{map[string][]ec2.Snapshot{
+			"20140627-000000": set("20140627-000000", "completed"),
+			"20140628-000000": set("20140628-000000", "completed"),
+			"20140629-000000": set("20140629-000000", "completed")},
+			SnapshotConfig{Keep: 2},
+			[]string{"20140627-000000"}},
+		// A set in progress neither counts nor is deleted.
+		{map[string][]ec2.Snapshot{
+			"20140627-000000": set("20140627-000000", "completed"),
+			"20140628-000000": set("20140628-000000", "completed"),
+			"20140629-000000": set("20140629-000000", "completed",
+				"pending")},
+			SnapshotConfig{Keep: 1},
+			[]string{"20140627-000000"}},
+		// Sets older than max_age go, except for the newest complete one.
+		{map[string][]ec2.Snapshot{
+			"20140501-000000": set("20140501-000000", "completed"),
+			"20140502-000000": set("20140502-000000", "completed"),
+			"20140629-000000": set("20140629-000000", "error")},
+			SnapshotConfig{MaxAge: 30},
+			[]string{"20140501-000000"}},
+		// Either limit expires a set.
+		{map[string][]ec2.Snapshot{
+			"20140501-000000": set("20140501-000000", "completed"),
+			"20140628-000000": set("20140628-000000", "completed"),
+			"20140629-000000": set("20140629-000000", "completed"),
+			"20140630-000000": set("20140630-000000", "completed")},
+			SnapshotConfig{Keep: 2, MaxAge: 30},
+			[]string{"20140501-000000", "20140628-000000"}},
+	}
+
+	for i, test := range tests {
+		var snapshots []ec2.Snapshot
+		for _, s := range test.sets {
+			snapshots = append(snapshots, s...)
+		}
+		names, sets := snapshotSets(snapshots)
+
+		expired := expiredSnapshotSets(names, sets, test.policy, now)
+		if !reflect.DeepEqual(expired, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, expired)
+		}
+	}
+}
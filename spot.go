@@ -0,0 +1,227 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// The default number of seconds to wait for a spot request to be fulfilled.
+const DEFAULT_SPOT_TIMEOUT = 600
+
+// Returned when a spot request was not fulfilled within the spot_timeout.
+var errSpotTimeout = fmt.Errorf("spot request was not fulfilled in time")
+
+func (node *Node) IsSpot() bool {
+	return node.Market == "spot"
+}
+
+// Returns the spot requests that were made for this node and are in one of
+// the given states.
+func (node *Node) SpotRequests(states ...string) ([]ec2.SpotRequestResult, error) {
+	filter := ec2.NewFilter()
+	filter.Add("tag:Name", node.Name)
+	filter.Add("state", states...)
+	addClusterFilter(filter)
+	resp, err := node.Conn().DescribeSpotRequests(nil, filter)
+	if err != nil {
+		return nil, err
+	}
+	return resp.SpotRequestResults, nil
+}
+
+// Launches the node on the spot market using the same options that would be
+// used for an on-demand launch. If the request is not fulfilled within the
+// node's spot_timeout it is cancelled and errSpotTimeout is returned.
+func (node *Node) startSpot(runInst *ec2.RunInstances) error {
+	// If a previous run left a request behind then we wait on that, or take
+	// the instance it was fulfilled with, rather than placing a second bid
+	// for the same node. A fulfilled request's instance is not found by
+	// Update until it has been tagged, which may never have happened.
+	existing, err := node.SpotRequests("open", "active")
+	if err != nil {
+		return fmt.Errorf("unable to list spot requests: %+v", err)
+	}
+
+	var requestId string
+	if len(existing) > 0 {
+		requestId = existing[0].SpotRequestId
+		printf("%s: using existing spot request %s\n", node.Name,
+			requestId)
+	} else {
+		spotReq := ec2.RequestSpotInstances{
+			SpotPrice:                node.SpotPrice,
+			InstanceCount:            1,
+			Type:                     "one-time",
+			ImageId:                  runInst.ImageId,
+			KeyName:                  runInst.KeyName,
+			InstanceType:             runInst.InstanceType,
+			SecurityGroups:           runInst.SecurityGroups,
+			UserData:                 runInst.UserData,
+			AvailZone:                runInst.AvailZone,
+			SubnetId:                 runInst.SubnetId,
+			AssociatePublicIpAddress: runInst.AssociatePublicIpAddress,
+			PrivateIPAddress:         runInst.PrivateIPAddress,
+			BlockDevices:             runInst.BlockDevices,
+			IamInstanceProfile:       runInst.IamInstanceProfile,
+			Monitoring:               runInst.Monitoring,
+			PlacementGroupName:       runInst.PlacementGroupName}
+		spotResp, err := node.Conn().RequestSpotInstances(&spotReq)
+		if err != nil {
+			return fmt.Errorf("spot request failed: %+v", err)
+		}
+
+		requestId = spotResp.SpotRequestResults[0].SpotRequestId
+		printf("%s: requested spot instance at %s (%s)\n", node.Name,
+			node.SpotPrice, requestId)
+
+		// Tag the request with the node name so that later runs (and
+		// teardown) can find it.
+		_, err = node.Conn().CreateTags([]string{requestId},
+			withClusterTag(ec2.Tag{Key: "Name", Value: node.Name}))
+		if err != nil {
+			debugf("%s: unable to tag spot request %s: %+v\n", node.Name,
+				requestId, err)
+		}
+	}
+
+	// Poll the request until it has an instance, fails or times out.
+	timeout := node.SpotTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_SPOT_TIMEOUT
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		instanceId, err := node.waitSpotRequest(requestId)
+		if err != nil {
+			return err
+		} else if instanceId != "" {
+			return node.adoptSpotInstance(instanceId)
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+
+	// Timed out; cancel the request so that it doesn't get fulfilled after
+	// we have moved on.
+	_, err = node.Conn().CancelSpotRequests([]string{requestId})
+	if err != nil {
+		return fmt.Errorf("unable to cancel spot request %s: %+v",
+			requestId, err)
+	}
+	printf("%s: cancelled spot request %s\n", node.Name, requestId)
+
+	// The request may have been fulfilled between the last poll and the
+	// cancellation, in which case the instance is still ours to use.
+	if instanceId, err := node.waitSpotRequest(requestId); err == nil &&
+		instanceId != "" {
+		return node.adoptSpotInstance(instanceId)
+	}
+
+	return errSpotTimeout
+}
+
+// Checks on the state of a spot request. This returns the instance id once
+// the request has been fulfilled, an empty string if it is still pending,
+// or an error if the request will never be fulfilled.
+func (node *Node) waitSpotRequest(requestId string) (string, error) {
+	resp, err := node.Conn().DescribeSpotRequests([]string{requestId}, nil)
+	if err != nil {
+		// Newly created requests are not always visible right away.
+		if ec2Err, ok := err.(*ec2.Error); ok &&
+			ec2Err.Code == "InvalidSpotInstanceRequestID.NotFound" {
+			return "", nil
+		}
+		return "", fmt.Errorf("AWS spot request update failed - %+v", err)
+	} else if len(resp.SpotRequestResults) != 1 {
+		return "", nil
+	}
+
+	result := resp.SpotRequestResults[0]
+	debugf("%s: spot request %s is %s (%s)\n", node.Name, requestId,
+		result.State, result.Status.Code)
+	switch {
+	case result.InstanceId != "":
+		return result.InstanceId, nil
+	case result.State == "open":
+		return "", nil
+	default:
+		return "", fmt.Errorf("spot request %s is %s: %s", requestId,
+			result.State, result.Status.Message)
+	}
+}
+
+// Makes the instance that fulfilled a spot request the node's instance.
+func (node *Node) adoptSpotInstance(instanceId string) error {
+	resp, err := node.Conn().Instances([]string{instanceId}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to describe spot instance %s: %+v",
+			instanceId, err)
+	} else if len(resp.Reservations) != 1 ||
+		len(resp.Reservations[0].Instances) != 1 {
+		return fmt.Errorf("spot instance %s not found", instanceId)
+	}
+
+	instance := &(resp.Reservations[0].Instances[0])
+	switch instance.State.Code & 0xff {
+	case STATE_PENDING, STATE_RUNNING:
+	default:
+		return fmt.Errorf("spot instance %s is %s", instanceId,
+			instance.State.Name)
+	}
+
+	node.Instance = instance
+	return nil
+}
+
+// Cancels any spot requests for this node that have not been fulfilled.
+func (node *Node) CancelSpotRequests() error {
+	open, err := node.SpotRequests("open")
+	if err != nil {
+		return err
+	} else if len(open) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(open))
+	for _, request := range open {
+		ids = append(ids, request.SpotRequestId)
+	}
+
+	_, err = node.Conn().CancelSpotRequests(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		printf("%s (%s): spot request cancelled\n", node.Name, id)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/ty/fun"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// How long a running instance has to pass its status checks. EC2 normally
+// takes a few minutes to run them after boot.
+const STATUS_CHECK_TIMEOUT = 15 * time.Minute
+
+// Displays the EC2 status checks and scheduled events of the target nodes.
+func health() error {
+	updateNodes(G_TARGETS, ARG_PARALLEL)
+	statuses, err := instanceStatuses(G_TARGETS)
+	if err != nil {
+		errorf("Unable to retrieve instance status: %+v\n", err)
+		return err
+	}
+
+	names := fun.Keys(G_TARGETS).([]string)
+	sort.Strings(names)
+
+	for _, name := range names {
+		node := G_TARGETS[name]
+		if node.Instance == nil {
+			continue
+		}
+
+		status := statuses[node.Instance.InstanceId]
+		if status == nil {
+			printf("%s\t%s\t%s\tsystem:-\tinstance:-\n", node.Name,
+				node.Instance.InstanceId, node.StateName())
+			continue
+		}
+
+		printf("%s\t%s\t%s\tsystem:%s\tinstance:%s\n", node.Name,
+			node.Instance.InstanceId, node.StateName(),
+			statusSummary(status.SystemStatus),
+			statusSummary(status.InstanceStatus))
+		for _, event := range status.Events {
+			printf("\tevent %s: %s (%s - %s)\n", event.Code,
+				event.Description, event.NotBefore, event.NotAfter)
+		}
+	}
+
+	return nil
+}
+
+// Retrieves the status checks for the instances of the nodes, keyed by
+// instance id. Only running instances have status checks, so nodes in any
+// other state are missing from the result.
+func instanceStatuses(nodes map[string]*Node) (map[string]*ec2.InstanceStatusSet, error) {
+	regions := make(map[string][]*Node)
+	for _, node := range nodes {
+		if node.IsRunning() {
+			regions[node.RegionId] = append(regions[node.RegionId], node)
+		}
+	}
+
+	statuses := make(map[string]*ec2.InstanceStatusSet)
+	for _, regionNodes := range regions {
+		ids := make([]string, len(regionNodes))
+		for i, node := range regionNodes {
+			ids[i] = node.Instance.InstanceId
+		}
+
+		// EC2 accepts at most 100 instance ids per request.
+		conn := regionNodes[0].Conn()
+		for len(ids) > 0 {
+			batch := ids
+			if len(batch) > 100 {
+				batch = batch[:100]
+			}
+			ids = ids[len(batch):]
+
+			resp, err := conn.DescribeInstanceStatus(
+				&ec2.DescribeInstanceStatus{InstanceIds: batch}, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			for i := range resp.InstanceStatus {
+				status := &resp.InstanceStatus[i]
+				statuses[status.InstanceId] = status
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// Retrieves the status checks of the node's instance, or nil if EC2 has no
+// status for it yet.
+func (node *Node) InstanceStatus() (*ec2.InstanceStatusSet, error) {
+	resp, err := node.Conn().DescribeInstanceStatus(&ec2.DescribeInstanceStatus{
+		InstanceIds: []string{node.Instance.InstanceId}}, nil)
+	if err != nil {
+		return nil, err
+	} else if len(resp.InstanceStatus) == 0 {
+		return nil, nil
+	}
+	return &resp.InstanceStatus[0], nil
+}
+
+// Summarizes the overall status of an instance; "ok" only if both the
+// system and the instance checks passed.
+func healthName(status *ec2.InstanceStatusSet) string {
+	switch {
+	case status == nil:
+		return "-"
+	case status.SystemStatus.Status == "impaired" ||
+		status.InstanceStatus.Status == "impaired":
+		return "impaired"
+	case status.SystemStatus.Status == "ok" &&
+		status.InstanceStatus.Status == "ok":
+		return "ok"
+	default:
+		return status.InstanceStatus.Status
+	}
+}
+
+// Formats a status check along with the names of any failed checks.
+func statusSummary(status ec2.Status) string {
+	failed := make([]string, 0)
+	for _, detail := range status.Details {
+		if detail.Status != "passed" && detail.Status != "initializing" {
+			failed = append(failed, detail.Name+"="+detail.Status)
+		}
+	}
+
+	if len(failed) == 0 {
+		return status.Status
+	}
+	return fmt.Sprintf("%s(%s)", status.Status, strings.Join(failed, ","))
+}
+
+// Waits for a running node to pass its system and instance reachability
+// checks. An impaired instance will not recover on its own, so this fails
+// as soon as either check does.
+func waitForStatusChecks(node *Node) error {
+	deadline := time.Now().Add(STATUS_CHECK_TIMEOUT)
+	for {
+		status, err := node.InstanceStatus()
+		if err != nil {
+			return fmt.Errorf("AWS status check failed - %+v", err)
+		}
+
+		switch healthName(status) {
+		case "ok":
+			return nil
+		case "impaired":
+			return fmt.Errorf("instance failed status checks - system:%s "+
+				"instance:%s", statusSummary(status.SystemStatus),
+				statusSummary(status.InstanceStatus))
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance did not pass status checks within %s",
+				STATUS_CHECK_TIMEOUT)
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,83 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+func TestHealthName(t *testing.T) {
+	status := func(system, instance string) *ec2.InstanceStatusSet {
+		return &ec2.InstanceStatusSet{
+			SystemStatus:   ec2.Status{Status: system},
+			InstanceStatus: ec2.Status{Status: instance}}
+	}
+
+	tests := []struct {
+		status   *ec2.InstanceStatusSet
+		expected string
+	}{
+		{nil, "-"},
+		{status("ok", "ok"), "ok"},
+		{status("impaired", "ok"), "impaired"},
+		{status("ok", "impaired"), "impaired"},
+		{status("initializing", "initializing"), "initializing"},
+		{status("ok", "initializing"), "initializing"},
+	}
+
+	for i, test := range tests {
+		if name := healthName(test.status); name != test.expected {
+			t.Errorf("%d: expected %s, got %s", i, test.expected, name)
+		}
+	}
+}
+
+func TestStatusSummary(t *testing.T) {
+	tests := []struct {
+		status   ec2.Status
+		expected string
+	}{
+		{ec2.Status{Status: "ok"}, "ok"},
+		{ec2.Status{Status: "ok", Details: []ec2.StatusDetails{
+			{Name: "reachability", Status: "passed"}}}, "ok"},
+		{ec2.Status{Status: "initializing", Details: []ec2.StatusDetails{
+			{Name: "reachability", Status: "initializing"}}},
+			"initializing"},
+		{ec2.Status{Status: "impaired", Details: []ec2.StatusDetails{
+			{Name: "reachability", Status: "failed"}}},
+			"impaired(reachability=failed)"},
+		{ec2.Status{Status: "impaired", Details: []ec2.StatusDetails{
+			{Name: "reachability", Status: "failed"},
+			{Name: "other", Status: "passed"},
+			{Name: "disk", Status: "insufficient-data"}}},
+			"impaired(reachability=failed,disk=insufficient-data)"},
+	}
+
+	for i, test := range tests {
+		if summary := statusSummary(test.status); summary != test.expected {
+			t.Errorf("%d: expected %s, got %s", i, test.expected, summary)
+		}
+	}
+}
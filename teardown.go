@@ -22,7 +22,19 @@
 
 package main
 
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
 func teardown() error {
+	master, revoke := teardownMaster()
+
+	// Nodes whose salt keys could not be revoked, for the final report.
+	var unrevoked []string
+	var unrevokedLock sync.Mutex
+
 	// Setup a channel for queuing requests for teardown and another
 	// for shutdown notification
 	teardownQueue := make(chan *Node)
@@ -33,7 +45,11 @@ func teardown() error {
 	for i := 0; i < ARG_PARALLEL; i++ {
 		go func() {
 			for node := range teardownQueue {
-				teardownNode(node)
+				if !teardownNode(node, master, revoke) {
+					unrevokedLock.Lock()
+					unrevoked = append(unrevoked, node.Name)
+					unrevokedLock.Unlock()
+				}
 			}
 			shutdownQueue <- true
 		}()
@@ -52,21 +68,93 @@ func teardown() error {
 		<-shutdownQueue
 	}
 
+	if len(unrevoked) > 0 {
+		sort.Strings(unrevoked)
+		errorf("Salt keys were not revoked for: %s\n",
+			strings.Join(unrevoked, ", "))
+		errorf("Run 'salt-key -d <id>' on the master to remove them.\n")
+	}
+
 	return nil
 }
 
-func teardownNode(node *Node) {
+// Returns the master to revoke the keys of torn down minions from, and
+// whether the keys need revoking at all; they go away with the master when it
+// is one of the nodes being torn down. The master is nil if it can't be
+// reached.
+func teardownMaster() (*Node, bool) {
+	master := G_CONFIG.findNodeByRole("saltmaster")
+	if master == nil {
+		return nil, false
+	} else if _, found := G_TARGETS[master.Name]; found {
+		debugf("Tearing down the master; not revoking salt keys\n")
+		return nil, false
+	}
+
+	err := master.Update()
+	if err != nil {
+		errorf("Unable to retrieve status of %s from AWS: %+v\n",
+			master.Name, err)
+		return nil, true
+	} else if !master.IsRunning() {
+		errorf("Master %s is not running; salt keys will not be revoked.\n",
+			master.Name)
+		return nil, true
+	} else if err = master.SshOpen(); err != nil {
+		errorf("Unable to open SSH connection to master: %+v\n", err)
+		return nil, true
+	}
+	return master, true
+}
+
+// Terminates the node and, if revoke is set, removes its salt key from the
+// master. This returns false if the node was terminated but its key could not
+// be revoked.
+func teardownNode(node *Node, master *Node, revoke bool) bool {
 	err := node.Update()
 	if err != nil {
 		printf("%s: not terminated; %+v\n", node.Name, err)
-		return
+		return true
 	}
 
-	err = node.Terminate()
+	// Make sure that no outstanding spot requests launch a new instance
+	// for this node after it has been terminated. This is done even for
+	// nodes that are no longer configured as spot nodes.
+	err = node.CancelSpotRequests()
 	if err != nil {
-		printf("%s: not terminated; %+v\n", node.Name, err)
-		return
+		printf("%s: unable to cancel spot requests; %+v\n", node.Name, err)
+	}
+
+	// Terminate before giving back the elastic IP, so that a node which is
+	// protected from termination keeps its address. A node whose instance
+	// is already gone may still have its key on the master, such as when an
+	// earlier teardown could not reach it, so that is revoked regardless.
+	if node.Instance == nil {
+		printf("%s: already terminated\n", node.Name)
+	} else {
+		instance := node.Instance
+		err = node.Terminate()
+		if err != nil {
+			printf("%s: not terminated; %+v\n", node.Name, err)
+			return true
+		}
+
+		err = node.ReleaseAddress(instance)
+		if err != nil {
+			printf("%s: unable to release address; %+v\n", node.Name, err)
+		}
 	}
 
-	// TODO: Revoke key from master
+	if !revoke {
+		return true
+	} else if master == nil {
+		return false
+	}
+
+	err = revokeSaltKey(master, node.Name)
+	if err != nil {
+		printf("%s: unable to revoke salt key; %+v\n", node.Name, err)
+		return false
+	}
+	return true
 }
@@ -23,9 +23,11 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 )
 
@@ -95,12 +97,40 @@ func pForEachValue(m interface{}, f interface{}, concurrent int) {
 // Fields inherited from an old to a new node.
 var inheritedFields map[string]bool = map[string]bool{
 	"Ami":      true,
+	"Image":    true,
 	"Flavor":   true,
 	"KeyName":  true,
 	"RegionId": true,
 	"SGroup":   true,
 	"Username": true,
 	"Zone":     true,
+	"Zones":    true,
+	"Vpc":      true,
+	"Subnet":   true,
+	"PublicIp": true,
+
+	"VpcPeering": true,
+
+	"IamProfile":            true,
+	"TerminationProtection": true,
+	"EbsOptimized":          true,
+	"Monitoring":            true,
+	"PlacementGroup":        true,
+	"Tenancy":               true,
+	"ShutdownBehavior":      true,
+
+	"Market":       true,
+	"SpotPrice":    true,
+	"SpotTimeout":  true,
+	"SpotFallback": true,
+
+	"Volumes": true,
+}
+
+// Returns the value of an optional flag from the config, which is false when
+// the flag is not set.
+func isTrue(flag *bool) bool {
+	return flag != nil && *flag
 }
 
 func inheritFieldsIfEmpty(to interface{}, from interface{}) {
@@ -125,10 +155,18 @@ func inheritFieldsIfEmpty(to interface{}, from interface{}) {
 		toField := toVal.Field(i)
 
 		// Check to see if the to field is empty (zero). If it is not empty
-		// then something was set and as such no copy should be done.
-		zero := reflect.Zero(toField.Type()).Interface()
-		if toVal.Field(i).Interface() != zero {
-			continue
+		// then something was set and as such no copy should be done. Slices
+		// can not be compared so they are considered empty if they have
+		// no elements.
+		if toField.Kind() == reflect.Slice {
+			if toField.Len() != 0 {
+				continue
+			}
+		} else {
+			zero := reflect.Zero(toField.Type()).Interface()
+			if toField.Interface() != zero {
+				continue
+			}
 		}
 
 		// The field exists and is empty, copy the contents from the 'from'
@@ -168,3 +206,24 @@ func updateNodes(nodes map[string]*Node, parallel int) (err error) {
 	wg.Wait()
 	return err
 }
+
+// Asks the user a yes/no question on the terminal, returning true only if
+// they answered yes. The -y flag answers yes to every question.
+func confirm(question string) bool {
+	if ARG_YES {
+		return true
+	}
+
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,75 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInheritFieldsIfEmpty(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		to       AwsConfig
+		from     AwsConfig
+		expected AwsConfig
+	}{
+		// Empty fields are inherited.
+		{AwsConfig{},
+			AwsConfig{Flavor: "m1.small", SGroup: SGroupList{"default"},
+				TerminationProtection: &yes},
+			AwsConfig{Flavor: "m1.small", SGroup: SGroupList{"default"},
+				TerminationProtection: &yes}},
+		// Set fields are kept.
+		{AwsConfig{Flavor: "m3.large", SGroup: SGroupList{"web"}},
+			AwsConfig{Flavor: "m1.small", SGroup: SGroupList{"default"}},
+			AwsConfig{Flavor: "m3.large", SGroup: SGroupList{"web"}}},
+		// An explicit false is not overridden.
+		{AwsConfig{TerminationProtection: &no, PublicIp: &no},
+			AwsConfig{TerminationProtection: &yes, PublicIp: &yes,
+				Monitoring: &yes},
+			AwsConfig{TerminationProtection: &no, PublicIp: &no,
+				Monitoring: &yes}},
+		// Fields that are per node are never inherited.
+		{AwsConfig{},
+			AwsConfig{PrivateIp: "10.0.0.5"},
+			AwsConfig{}},
+	}
+
+	for i, test := range tests {
+		to := test.to
+		inheritFieldsIfEmpty(&to, &test.from)
+		if !reflect.DeepEqual(to, test.expected) {
+			t.Errorf("%d: expected %+v, got %+v", i, test.expected, to)
+		}
+	}
+}
+
+func TestIsTrue(t *testing.T) {
+	yes, no := true, false
+	if isTrue(nil) || isTrue(&no) || !isTrue(&yes) {
+		t.Errorf("isTrue(nil, false, true) = %t, %t, %t", isTrue(nil),
+			isTrue(&no), isTrue(&yes))
+	}
+}
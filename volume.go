@@ -0,0 +1,322 @@
+// -------------------------------------------------------------------
+//
+// salter: Tool for bootstrap salt clusters in EC2
+//
+// Copyright (c) 2013-2014 Orchestrate, Inc. All Rights Reserved.
+//
+// This file is provided to you under the Apache License,
+// Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License.  You may obtain
+// a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+// -------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// An EBS volume attached to a node, defined via [[nodes.X.volumes]] in the
+// config file.
+type VolumeConfig struct {
+	// If set, the volume is persistent. It is created the first time the
+	// node is launched and re-attached to the node every time it is
+	// relaunched, rather than being part of the launch block device mapping.
+	Name string `toml:"name"`
+
+	// The device the volume is attached as (/dev/sdf etc).
+	Device string `toml:"device"`
+
+	// If true this entry resizes the root volume of the image; the device
+	// is taken from the AMI.
+	Root bool `toml:"root"`
+
+	// Size in GiB, EBS volume type (standard, gp2, io1) and the number of
+	// IOPS to provision for io1 volumes.
+	Size int64  `toml:"size"`
+	Type string `toml:"type"`
+	Iops int64  `toml:"iops"`
+
+	// Create the volume from this snapshot.
+	Snapshot string `toml:"snapshot"`
+
+	// Defaults to true. Ignored for persistent (named) volumes.
+	DeleteOnTermination *bool `toml:"delete_on_termination"`
+}
+
+// Formats the volume for display by the dump command.
+func (v VolumeConfig) String() string {
+	return fmt.Sprintf("{Name:%s Device:%s Root:%t Size:%d Type:%s Iops:%d "+
+		"Snapshot:%s DeleteOnTermination:%t}", v.Name, v.Device, v.Root,
+		v.Size, v.Type, v.Iops, v.Snapshot, v.deleteOnTermination())
+}
+
+// Checks that the volume configuration makes sense.
+func (v *VolumeConfig) validate() error {
+	switch {
+	case v.Root && v.Device != "":
+		return fmt.Errorf("root volumes can not specify a device")
+	case v.Root && v.Name != "":
+		return fmt.Errorf("root volumes can not be persistent")
+	case !v.Root && v.Device == "":
+		return fmt.Errorf("volumes require a device")
+	case v.Name != "" && v.Size == 0 && v.Snapshot == "":
+		return fmt.Errorf("%s: persistent volumes require a size or snapshot",
+			v.Name)
+	case v.Type == "io1" && v.Iops == 0:
+		return fmt.Errorf("%s: io1 volumes require iops", v.Device)
+	case v.Type != "io1" && v.Iops != 0:
+		return fmt.Errorf("%s: iops can only be used with io1 volumes",
+			v.Device)
+	}
+	return nil
+}
+
+func (v *VolumeConfig) deleteOnTermination() bool {
+	return v.DeleteOnTermination == nil || *v.DeleteOnTermination
+}
+
+// The value of the Name tag used to find a persistent volume.
+func (node *Node) volumeTagName(v *VolumeConfig) string {
+	return node.Name + "-" + v.Name
+}
+
+// Returns the snapshot a volume on the given device should be created from;
+// the snapshot being restored if there is one, otherwise the configured one.
+func (node *Node) volumeSnapshot(device, snapshot string) string {
+	if id, found := node.restoreSnapshots[device]; found {
+		return id
+	}
+	return snapshot
+}
+
+// Generates the block device mappings for launching the node from the given
+// AMI. These are the ephemeral disks for the flavor plus every
+// non-persistent volume.
+func (node *Node) blockDeviceMappings(ami string) ([]ec2.BlockDeviceMapping, error) {
+	// The AMI's root device is only needed to resize the root volume or to
+	// keep restored snapshots off it.
+	rootDevice := ""
+	needRoot := len(node.restoreSnapshots) > 0
+	for _, v := range node.Volumes {
+		needRoot = needRoot || v.Root
+	}
+	if needRoot {
+		var err error
+		if rootDevice, err = node.rootDeviceName(ami); err != nil {
+			return nil, err
+		}
+	}
+
+	mappings := make([]ec2.BlockDeviceMapping, 0)
+	configured := map[string]bool{rootDevice: true}
+	for _, v := range node.Volumes {
+		if v.Name != "" {
+			configured[v.Device] = true
+			continue
+		}
+
+		device := v.Device
+		snapshot := node.volumeSnapshot(device, v.Snapshot)
+		if v.Root {
+			device = rootDevice
+			snapshot = v.Snapshot
+		}
+
+		mappings = append(mappings, ec2.BlockDeviceMapping{
+			DeviceName:          device,
+			SnapshotId:          snapshot,
+			VolumeType:          v.Type,
+			VolumeSize:          v.Size,
+			IOPS:                v.Iops,
+			DeleteOnTermination: v.deleteOnTermination()})
+		configured[device] = true
+	}
+
+	// Restored volumes that aren't in the config are recreated as they were,
+	// except for the root volume which always comes from the AMI.
+	for device, snapshot := range node.restoreSnapshots {
+		if !configured[device] {
+			mappings = append(mappings, ec2.BlockDeviceMapping{
+				DeviceName:          device,
+				SnapshotId:          snapshot,
+				DeleteOnTermination: true})
+			configured[device] = true
+		}
+	}
+
+	// Configured volumes win over ephemeral disks using the same device.
+	for _, mapping := range deviceMappings(node.Flavor) {
+		if !configured[mapping.DeviceName] {
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	return mappings, nil
+}
+
+// Looks up the root device name of an AMI.
+func (node *Node) rootDeviceName(ami string) (string, error) {
+	resp, err := node.Conn().Images([]string{ami}, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to describe %s: %+v", ami, err)
+	} else if len(resp.Images) != 1 {
+		return "", fmt.Errorf("image %s not found", ami)
+	}
+	return resp.Images[0].RootDeviceName, nil
+}
+
+// Finds the persistent volume from a previous launch of this node. This
+// returns nil if the volume has not been created yet.
+func (node *Node) findVolume(v *VolumeConfig) (*ec2.Volume, error) {
+	filter := ec2.NewFilter()
+	filter.Add("tag:Name", node.volumeTagName(v))
+	resp, err := node.Conn().Volumes(nil, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Volumes of other clusters are ignored, but one created before
+	// clusters were tagged must be claimed rather than replaced.
+	volumes := make([]ec2.Volume, 0, len(resp.Volumes))
+	for _, vol := range resp.Volumes {
+		if cluster, found := findTag(vol.Tags, CLUSTER_TAG); !found {
+			return nil, checkCluster(vol.VolumeId, vol.Tags)
+		} else if cluster == G_CONFIG.Cluster {
+			volumes = append(volumes, vol)
+		}
+	}
+
+	switch len(volumes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &volumes[0], nil
+	default:
+		return nil, fmt.Errorf("more than one volume named %s",
+			node.volumeTagName(v))
+	}
+}
+
+// Returns the availability zone the node must be launched in. Volumes can
+// only be attached within their zone, so if the node has existing persistent
+// volumes it is pinned to their zone.
+func (node *Node) launchZone() (string, error) {
+	zone := node.Zone
+	for i := range node.Volumes {
+		v := &node.Volumes[i]
+		if v.Name == "" {
+			continue
+		}
+
+		vol, err := node.findVolume(v)
+		if err != nil {
+			return "", err
+		} else if vol == nil {
+			continue
+		}
+
+		if zone == "" {
+			zone = vol.AvailZone
+		} else if zone != vol.AvailZone {
+			return "", fmt.Errorf("volume %s (%s) is in %s, not %s",
+				node.volumeTagName(v), vol.VolumeId, vol.AvailZone, zone)
+		}
+	}
+	return zone, nil
+}
+
+// Attaches each of the node's persistent volumes, creating them if this is
+// the first time the node has been launched. Volumes that are already
+// attached to the node are left alone.
+func (node *Node) AttachVolumes() error {
+	for i := range node.Volumes {
+		v := &node.Volumes[i]
+		if v.Name == "" {
+			continue
+		}
+
+		vol, err := node.findVolume(v)
+		if err != nil {
+			return err
+		}
+
+		if vol == nil {
+			vol, err = node.createVolume(v)
+			if err != nil {
+				return err
+			}
+		} else if len(vol.Attachments) > 0 {
+			attachment := vol.Attachments[0]
+			if attachment.InstanceId == node.Instance.InstanceId {
+				continue
+			}
+			return fmt.Errorf("volume %s (%s) is attached to %s",
+				node.volumeTagName(v), vol.VolumeId, attachment.InstanceId)
+		}
+
+		_, err = node.Conn().AttachVolume(vol.VolumeId,
+			node.Instance.InstanceId, v.Device)
+		if err != nil {
+			return fmt.Errorf("unable to attach %s: %+v", vol.VolumeId, err)
+		}
+		printf("%s: attached %s (%s) as %s\n", node.Name,
+			node.volumeTagName(v), vol.VolumeId, v.Device)
+	}
+	return nil
+}
+
+// Creates a persistent volume in the node's zone and waits for it to become
+// available.
+func (node *Node) createVolume(v *VolumeConfig) (*ec2.Volume, error) {
+	resp, err := node.Conn().CreateVolume(&ec2.CreateVolume{
+		AvailZone:  node.Instance.AvailZone,
+		Size:       v.Size,
+		SnapshotId: node.volumeSnapshot(v.Device, v.Snapshot),
+		VolumeType: v.Type,
+		IOPS:       v.Iops})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create volume %s: %+v",
+			node.volumeTagName(v), err)
+	}
+
+	_, err = node.Conn().CreateTags([]string{resp.VolumeId},
+		withClusterTag(ec2.Tag{Key: "Name", Value: node.volumeTagName(v)}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to tag volume %s: %+v",
+			resp.VolumeId, err)
+	}
+	printf("%s: created %s (%s)\n", node.Name, node.volumeTagName(v),
+		resp.VolumeId)
+
+	for {
+		volResp, err := node.Conn().Volumes([]string{resp.VolumeId}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("AWS volume update failed - %+v", err)
+		} else if len(volResp.Volumes) == 1 {
+			switch volResp.Volumes[0].Status {
+			case "available":
+				return &volResp.Volumes[0], nil
+			case "creating":
+			default:
+				return nil, fmt.Errorf("unexpected volume state - %s",
+					volResp.Volumes[0].Status)
+			}
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}